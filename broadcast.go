@@ -0,0 +1,344 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"runtime"
+	"time"
+)
+
+// the broadcaster serializes each message once, and hands it to shards that
+// each own some of the observers. shards index their observers by the
+// languages they're filtering for, so a post only visits the observers that
+// could want it, and check the rest of each one's filter before queueing.
+//
+// to see how many observers it keeps up with:
+//
+//	go test -run '^$' -bench BenchmarkBroadcast -benchtime 1000x
+//
+// that sends 100 posts/s (picked as headroom for bursts of deletes) through
+// filtering, queueing and the websocket writes, over in-memory pipes rather
+// than the network. on a 1 vCPU Xeon VM (go 1.27), up to 5k observers get
+// every post, at most ~0.5s late. at 6k a few get dropped and posts are up to
+// ~0.9s late, and by 7.5k it only manages ~65 posts/s. MAX_OBSERVERS defaults
+// to 5k from that.
+//
+// filtering and fanning out is ~15% of the cpu (matching ~7%). the rest is
+// observers waking, taking their queues and writing (and the pipes' reading
+// ends), so the limit follows the number of observers more than their
+// filters.
+
+const shardEventBuffer = 256
+
+var observersCountRefresh time.Duration = MustParseDuration("7s")
+
+// broadcastMessage is a message ready to send, shared by every observer
+type broadcastMessage struct {
+	message ObserverMessage
+	at      time.Time
+	// serialized and framed once per encoding, and compressed once if it's
+	// negotiated, for every connection
+	frames []preparedFrame
+}
+
+func newBroadcastMessage(message ObserverMessage, at time.Time) *broadcastMessage {
+	return &broadcastMessage{
+		message: message,
+		at:      at,
+		frames:  make([]preparedFrame, len(encodings)),
+	}
+}
+
+// prepared is the message for an encoding, or nil if it failed to serialize
+func (bm *broadcastMessage) prepared(enc *Encoding) *websocket.PreparedMessage {
+	frame := &bm.frames[enc.id]
+	frame.once.Do(func() {
+		wire, err := bm.message.wire(bm.at, nil)
+		if err != nil {
+			log.Println("failed to serialize message", err)
+			return
+		}
+		data, err := enc.Marshal(wire)
+		if err != nil {
+			log.Println("failed to serialize message", err)
+			return
+		}
+		if frame.prepared, err = websocket.NewPreparedMessage(enc.FrameType, data); err != nil {
+			log.Println("failed to prepare message", err)
+		}
+	})
+	return frame.prepared
+}
+
+// langIndex finds the observers that might want a post by its languages,
+// following the same rules as ListeningFor (and filterMatcher.listening, for
+// detected languages)
+type langIndex struct {
+	// no languages picked: everything
+	everything map[*observer]bool
+	// picked these languages
+	byLang map[string]map[*observer]bool
+	// picked these languages, and wants them detected too
+	byDetected map[string]map[*observer]bool
+	// picked posts without a language
+	unknown map[*observer]bool
+	// where each observer is indexed, for moving it
+	indexed map[*observer][]*string
+}
+
+func newLangIndex() *langIndex {
+	return &langIndex{
+		everything: map[*observer]bool{},
+		byLang:     map[string]map[*observer]bool{},
+		byDetected: map[string]map[*observer]bool{},
+		unknown:    map[*observer]bool{},
+		indexed:    map[*observer][]*string{},
+	}
+}
+
+func addTo(byLang map[string]map[*observer]bool, lang string, o *observer) {
+	if byLang[lang] == nil {
+		byLang[lang] = map[*observer]bool{}
+	}
+	byLang[lang][o] = true
+}
+
+func removeFrom(byLang map[string]map[*observer]bool, lang string, o *observer) {
+	delete(byLang[lang], o)
+	if len(byLang[lang]) == 0 {
+		delete(byLang, lang)
+	}
+}
+
+func (idx *langIndex) add(o *observer, langs []*string, detected bool) {
+	idx.remove(o)
+	idx.indexed[o] = langs
+	picked := 0
+	for _, lang := range langs {
+		if lang == nil {
+			idx.unknown[o] = true
+			continue
+		}
+		canonical, err := CanonicalLang(*lang)
+		if err != nil {
+			continue // filters are validated before getting here
+		}
+		picked += 1
+		addTo(idx.byLang, canonical, o)
+		if detected {
+			addTo(idx.byDetected, canonical, o)
+		}
+	}
+	if picked == 0 && !idx.unknown[o] {
+		idx.everything[o] = true
+	}
+}
+
+func (idx *langIndex) remove(o *observer) {
+	langs, ok := idx.indexed[o]
+	if !ok {
+		return
+	}
+	for _, lang := range langs {
+		if lang == nil {
+			continue
+		}
+		if canonical, err := CanonicalLang(*lang); err == nil {
+			removeFrom(idx.byLang, canonical, o)
+			removeFrom(idx.byDetected, canonical, o)
+		}
+	}
+	delete(idx.unknown, o)
+	delete(idx.everything, o)
+	delete(idx.indexed, o)
+}
+
+func (idx *langIndex) has(o *observer) bool {
+	_, ok := idx.indexed[o]
+	return ok
+}
+
+// forPost calls fn once for each observer that might want a post
+func (idx *langIndex) forPost(postLangs, detectedLangs []string, fn func(*observer)) {
+	for o := range idx.everything {
+		fn(o)
+	}
+	byLang := idx.byLang
+	seen := map[*observer]bool{}
+	if len(postLangs) == 0 {
+		for o := range idx.unknown {
+			seen[o] = true
+			fn(o)
+		}
+		if len(detectedLangs) == 0 || len(idx.byDetected) == 0 {
+			return
+		}
+		byLang, postLangs = idx.byDetected, detectedLangs
+	}
+	keys := []string{}
+	for _, lang := range postLangs {
+		keys = append(keys, ListenKeys(lang)...)
+	}
+	if len(keys) == 1 && len(seen) == 0 {
+		for o := range byLang[keys[0]] {
+			fn(o)
+		}
+		return
+	}
+	for _, key := range keys {
+		for o := range byLang[key] {
+			if !seen[o] {
+				seen[o] = true
+				fn(o)
+			}
+		}
+	}
+}
+
+func (idx *langIndex) forAll(fn func(*observer)) {
+	for o := range idx.indexed {
+		fn(o)
+	}
+}
+
+// shardEvent is one of: a message to fan out, an observer joining, leaving,
+// or changing its filter, or a flush to wait for everything before it
+type shardEvent struct {
+	message *broadcastMessage
+	join    *observer
+	leave   *observer
+	filter  *observerFilter
+	flushed chan<- struct{}
+}
+
+type observerFilter struct {
+	observer *observer
+	matcher  *filterMatcher
+}
+
+type broadcastShard struct {
+	events chan shardEvent
+	index  *langIndex
+	// messages pushed to observers, for the benchmark
+	pushed int
+}
+
+func newBroadcastShard(unregister func(*observer)) *broadcastShard {
+	shard := &broadcastShard{
+		events: make(chan shardEvent, shardEventBuffer),
+		index:  newLangIndex(),
+	}
+	go shard.run(unregister)
+	return shard
+}
+
+func (shard *broadcastShard) run(unregister func(*observer)) {
+	for event := range shard.events {
+		switch {
+		case event.message != nil:
+			shard.fanOut(event.message, unregister)
+		case event.join != nil:
+			filter := event.join.matcher.filter
+			shard.index.add(event.join, filter.Langs, filter.Detected)
+		case event.leave != nil:
+			shard.index.remove(event.leave)
+		case event.filter != nil:
+			if o := event.filter.observer; shard.index.has(o) {
+				o.matcher = event.filter.matcher
+				shard.index.add(o, o.matcher.filter.Langs, o.matcher.filter.Detected)
+			}
+		case event.flushed != nil:
+			close(event.flushed)
+		}
+	}
+}
+
+func (shard *broadcastShard) fanOut(message *broadcastMessage, unregister func(*observer)) {
+	push := func(o *observer, highlights []Highlight) {
+		shard.pushed += 1
+		if stuck := o.push(message, highlights, message.at); stuck {
+			if o.conn != nil {
+				log.Println("disconnecting stuck client", o.conn.RemoteAddr())
+			}
+			shard.index.remove(o)
+			observerStuckCounter.Inc()
+			// through the broadcaster, which is maybe waiting on this shard
+			go unregister(o)
+		}
+	}
+	if message.message.Type == ObserverMessageTypePost {
+		liked := message.message.Post
+		shard.index.forPost(liked.Post.Langs, liked.Post.DetectedLangs, func(o *observer) {
+			if matches, highlights := o.matcher.matchesRouted(liked, message.at); matches {
+				push(o, highlights)
+			}
+		})
+	} else {
+		shard.index.forAll(func(o *observer) { push(o, nil) })
+	}
+}
+
+func newBroadcastShards(unregister func(*observer)) []*broadcastShard {
+	shards := make([]*broadcastShard, runtime.GOMAXPROCS(0))
+	for i := range shards {
+		shards[i] = newBroadcastShard(unregister)
+	}
+	return shards
+}
+
+func (s *Server) send(message ObserverMessage) {
+	prepared := newBroadcastMessage(message, time.Now())
+	for _, shard := range s.shards {
+		shard.events <- shardEvent{message: prepared}
+	}
+}
+
+// flush waits for the shards to finish everything sent so far
+func (s *Server) flush() {
+	for _, shard := range s.shards {
+		flushed := make(chan struct{})
+		shard.events <- shardEvent{flushed: flushed}
+		<-flushed
+	}
+}
+
+func (s *Server) broadcast(deletedFeed <-chan LikedPersistedPost, langStatsFeed <-chan LangStats) {
+	observers := 0
+	nextShard := 0
+	observersCountTicker := time.NewTicker(observersCountRefresh)
+
+	sendCount := func() {
+		observersCountTicker.Reset(observersCountRefresh)
+		s.send(ObserverMessage{
+			Type:           ObserverMessageTypeObservers,
+			ObserversCount: observers,
+		})
+		observersCount.Set(float64(observers))
+	}
+
+	for {
+		select {
+		case <-observersCountTicker.C:
+			sendCount()
+		case likedPost := <-deletedFeed:
+			s.send(ObserverMessage{
+				Type: ObserverMessageTypePost,
+				Post: &likedPost,
+			})
+		case stats := <-langStatsFeed:
+			s.updateLangs(stats)
+		case filter := <-s.observerFilters:
+			filter.observer.shard.events <- shardEvent{filter: &filter}
+		case o := <-s.leftObserver:
+			o.shard.events <- shardEvent{leave: o}
+			observers -= 1
+			sendCount()
+		case o := <-s.newObserver:
+			o.shard = s.shards[nextShard]
+			nextShard = (nextShard + 1) % len(s.shards)
+			o.shard.events <- shardEvent{join: o}
+			observers += 1
+			sendCount()
+		}
+	}
+}
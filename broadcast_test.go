@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLangIndexMatchesListeningFor(t *testing.T) {
+	en, ja, ptBR, zhHant, upperEN := "en", "ja", "pt-BR", "zh-Hant", "EN"
+	observerLangs := [][]*string{
+		{},
+		{nil},
+		{&en},
+		{&en, nil},
+		{&en, &ja},
+		{&ptBR},
+		{&zhHant, &en},
+		{&upperEN},
+	}
+	postLangs := [][]string{{}, {"en"}, {"ja"}, {"pt"}, {"en", "ja"}, {"pt", "ja"},
+		{"pt-BR"}, {"pt-PT"}, {"en-US", "en"}, {"zh-TW"}, {"zh-Hans"}}
+
+	// posts without a declared language, by their detected one
+	detectedLangs := [][]string{{}, {"en"}, {"ja"}, {"en-GB"}}
+
+	idx := newLangIndex()
+	observers := map[*observer]ObserverFilter{}
+	for _, langs := range observerLangs {
+		for _, detected := range []bool{false, true} {
+			o := newObserver(nil)
+			idx.add(o, langs, detected)
+			observers[o] = ObserverFilter{Langs: langs, Detected: detected}
+		}
+	}
+
+	check := func(post *PersistedPost) {
+		got := map[*observer]int{}
+		idx.forPost(post.Langs, post.DetectedLangs, func(o *observer) { got[o] += 1 })
+		for o, filter := range observers {
+			matcher, _ := filter.Matcher()
+			want := matcher.listening(post)
+			if want && got[o] != 1 {
+				t.Fatalf("observer %#v should get post %#v once, got %d", filter, post, got[o])
+			}
+			if !want && got[o] != 0 {
+				t.Fatalf("observer %#v shouldn't get post %#v", filter, post)
+			}
+		}
+	}
+	for _, langs := range postLangs {
+		check(&PersistedPost{Langs: langs})
+	}
+	for _, detected := range detectedLangs {
+		check(&PersistedPost{Langs: []string{}, DetectedLangs: detected})
+	}
+
+	// moving and removing
+	o := newObserver(nil)
+	idx.add(o, []*string{&ja}, true)
+	idx.add(o, []*string{&en}, false)
+	found := false
+	idx.forPost([]string{}, []string{"ja"}, func(other *observer) { found = found || other == o })
+	if found {
+		t.Fatalf("observer should have moved off of ja")
+	}
+	idx.remove(o)
+	idx.forPost([]string{"en"}, nil, func(other *observer) { found = found || other == o })
+	if found {
+		t.Fatalf("observer should be gone")
+	}
+}
+
+func TestShardQueuesOnlyMatchingPosts(t *testing.T) {
+	shard := newBroadcastShard(func(*observer) {})
+	o := newObserver(nil)
+	o.matcher, _ = ObserverFilter{Targets: []string{"reply"}, Keywords: []string{"cat"}}.Matcher()
+	shard.events <- shardEvent{join: o}
+
+	reply := ReplyTarget
+	now := time.Now()
+	for i := 0; i < observerQueueSize*2; i++ {
+		post := &PersistedPost{TimeUS: now.UnixMicro(), Text: "a dog", Langs: []string{"en"}}
+		shard.events <- shardEvent{message: newBroadcastMessage(ObserverMessage{
+			Type: ObserverMessageTypePost,
+			Post: &LikedPersistedPost{Post: post},
+		}, now)}
+	}
+	shard.events <- shardEvent{message: newBroadcastMessage(ObserverMessage{
+		Type: ObserverMessageTypePost,
+		Post: &LikedPersistedPost{Post: &PersistedPost{TimeUS: now.UnixMicro(), Text: "my cat", Target: &reply}},
+	}, now)}
+	flushed := make(chan struct{})
+	shard.events <- shardEvent{flushed: flushed}
+	<-flushed
+
+	messages, dropped := o.take()
+	if dropped != 0 || len(messages) != 1 {
+		t.Fatalf("expected just the matching post and nothing dropped, got %d and %d dropped", len(messages), dropped)
+	}
+	if h := messages[0].highlights; len(h) != 1 || h[0] != (Highlight{3, 6}) {
+		t.Fatalf("expected the post's highlights to be queued with it, got %#v", h)
+	}
+}
+
+// benchConn is the server's end of a websocket over an in-memory pipe, with
+// everything the client is sent read and thrown away
+func benchConn(b *testing.B, s *Server) *websocket.Conn {
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	c, err := s.upgrader.Upgrade(hijackRecorder{httptest.NewRecorder(), server}, r, nil)
+	if err != nil {
+		b.Fatalf("failed to upgrade: %#v", err)
+	}
+	return c
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+// the rate BenchmarkBroadcast sends posts at
+const benchPostsPerSecond = 100
+
+// go test -run '^$' -bench BenchmarkBroadcast -benchtime 1000x
+func BenchmarkBroadcast(b *testing.B) {
+	for _, observers := range []int{1_000, 2_500, 5_000, 7_500, 10_000} {
+		b.Run(fmt.Sprintf("observers=%d", observers), func(b *testing.B) {
+			benchmarkBroadcast(b, observers)
+		})
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, observers int) {
+	en, ja, pt := "en", "ja", "pt"
+	noBulk := false
+	observerFilters := []ObserverFilter{
+		{Langs: []*string{&en}},
+		{Langs: []*string{&en}, Targets: []string{"post"}},
+		{Langs: []*string{&ja}},
+		{Langs: []*string{&pt}, MinAgeMs: 1},
+		{Langs: []*string{&en, &pt}, Bulk: &noBulk},
+		{},
+		{Langs: []*string{nil}},
+		{Langs: []*string{&en}, Keywords: []string{"cat"}},
+	}
+	postLangs := [][]string{{"en"}, {"ja"}, {"pt"}, {"de"}, {}, {"en"}}
+	postTexts := []string{"deleted post %d", "my cat, post %d"}
+
+	s := newServer(NewObserverLimits(nil, nil, 0, 0, 0), nil, NewErrorReports())
+	conns := []*websocket.Conn{}
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	// to wait for the sockets to catch up, and see how far behind they got
+	var written, dropped, maxLagUS atomic.Int64
+	for i := 0; i < observers; i++ {
+		o := newObserver(benchConn(b, s))
+		conns = append(conns, o.conn)
+		o.shard = s.shards[i%len(s.shards)]
+		o.matcher, _ = observerFilters[i%len(observerFilters)].Matcher()
+		o.shard.events <- shardEvent{join: o}
+		// notify's writes, minus its pings and replies
+		go func() {
+			for {
+				select {
+				case <-o.wake:
+					messages, missed := o.take()
+					for _, message := range messages {
+						if err := writeObserverMessage(o.conn, o.enc, message); err != nil {
+							b.Errorf("failed to write: %#v", err)
+							return
+						}
+					}
+					written.Add(int64(len(messages)))
+					dropped.Add(int64(missed))
+					if len(messages) > 0 {
+						lag := time.Since(messages[0].at).Microseconds()
+						for seen := maxLagUS.Load(); lag > seen && !maxLagUS.CompareAndSwap(seen, lag); {
+							seen = maxLagUS.Load()
+						}
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	s.flush()
+	for _, shard := range s.shards {
+		shard.pushed = 0
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Until(start.Add(time.Duration(i) * time.Second / benchPostsPerSecond)))
+		s.send(ObserverMessage{
+			Type: ObserverMessageTypePost,
+			Post: &LikedPersistedPost{Post: &PersistedPost{
+				TimeUS: time.Now().Add(-time.Minute).UnixMicro(),
+				Text:   fmt.Sprintf(postTexts[i%len(postTexts)], i),
+				Langs:  postLangs[i%len(postLangs)],
+			}},
+		})
+	}
+	s.flush()
+	pushed := 0
+	for _, shard := range s.shards {
+		pushed += shard.pushed
+	}
+	for written.Load()+dropped.Load() < int64(pushed) {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "posts/s")
+	b.ReportMetric(float64(written.Load())/b.Elapsed().Seconds(), "deliveries/s")
+	b.ReportMetric(float64(dropped.Load())/float64(max(pushed, 1)), "dropped/delivery")
+	b.ReportMetric(float64(maxLagUS.Load())/1000, "max-lag-ms")
+}
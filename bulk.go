@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type DeletionKind string
+
+const (
+	OrganicDeletion DeletionKind = "organic"
+	BulkDeletion    DeletionKind = "bulk"
+)
+
+// BulkTracker watches the rate of deletes per account to spot cascading
+// deletions: account wipes and mass-delete tools that would otherwise flood
+// every observer's screen.
+//
+// it counts *every* delete, including cache misses: most of a wipe is usually
+// old posts we never saw, which lets us flag the burst before the few posts we
+// do have come through.
+type BulkTracker struct {
+	lock      sync.Mutex
+	window    time.Duration
+	threshold int
+	recent    map[string][]time.Time
+}
+
+func NewBulkTracker(window time.Duration, threshold int) *BulkTracker {
+	return &BulkTracker{
+		window:    window,
+		threshold: threshold,
+		recent:    map[string][]time.Time{},
+	}
+}
+
+// Observe records a delete from an account and classifies it. the first few
+// deletes of a burst (before the threshold is crossed) are still organic.
+func (b *BulkTracker) Observe(did string, t time.Time) DeletionKind {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cutoff := t.Add(-b.window)
+	kept := b.recent[did][:0]
+	for _, seen := range b.recent[did] {
+		if seen.After(cutoff) {
+			kept = append(kept, seen)
+		}
+	}
+	kept = append(kept, t)
+	if len(kept) > b.threshold {
+		// we only ever need to know if there are at least threshold deletes in
+		// the window, so don't let a wipe grow this unbounded
+		kept = kept[len(kept)-b.threshold:]
+	}
+	b.recent[did] = kept
+
+	if len(kept) >= b.threshold {
+		return BulkDeletion
+	}
+	return OrganicDeletion
+}
+
+// Sweep forgets accounts with no deletes in the window before t
+func (b *BulkTracker) Sweep(t time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cutoff := t.Add(-b.window)
+	for did, seen := range b.recent {
+		if len(seen) == 0 || !seen[len(seen)-1].After(cutoff) {
+			delete(b.recent, did)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBulkTracker(t *testing.T) {
+	start := time.UnixMicro(1_700_000_000_000_000)
+	b := NewBulkTracker(time.Minute, 3)
+
+	if b.Observe("did:plc:a", start) != OrganicDeletion {
+		t.Fatalf("a single delete is organic")
+	}
+	if b.Observe("did:plc:a", start.Add(time.Second)) != OrganicDeletion {
+		t.Fatalf("deletes under the threshold are organic")
+	}
+	if b.Observe("did:plc:b", start.Add(time.Second)) != OrganicDeletion {
+		t.Fatalf("deletes are counted per account")
+	}
+	if b.Observe("did:plc:a", start.Add(2*time.Second)) != BulkDeletion {
+		t.Fatalf("reaching the threshold is bulk")
+	}
+	if b.Observe("did:plc:a", start.Add(3*time.Second)) != BulkDeletion {
+		t.Fatalf("continuing the burst is bulk")
+	}
+	if b.Observe("did:plc:a", start.Add(2*time.Minute)) != OrganicDeletion {
+		t.Fatalf("deletes after the window are organic again")
+	}
+}
+
+func TestBulkTrackerSweep(t *testing.T) {
+	start := time.UnixMicro(1_700_000_000_000_000)
+	b := NewBulkTracker(time.Minute, 3)
+	b.Observe("did:plc:a", start)
+	b.Observe("did:plc:b", start.Add(50*time.Second))
+
+	b.Sweep(start.Add(70 * time.Second))
+	if _, ok := b.recent["did:plc:a"]; ok {
+		t.Fatalf("quiet accounts should be forgotten")
+	}
+	if _, ok := b.recent["did:plc:b"]; !ok {
+		t.Fatalf("accounts with recent deletes should be kept")
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cache key spaces:
+//
+//   t/<time_us>/<rkey>_<did> => PersistedPost json. ordered by the time jetstream
+//                               saw the post (zero-padded so it sorts), which
+//                               is what TrimEvents range-deletes over.
+//   k/<rkey>_<did>           => the post's t/ key, for finding it from a
+//                               delete or update.
+//   did/<did>/<rkey>         => empty. index of cached posts by account.
+//   meta/<name>              => bookkeeping, like which migrations have run.
+//
+// the k/ and did/ entries are written, deleted and trimmed in the same batch
+// as the post itself.
+//
+// caches from before the time-ordered layout have post keys of just
+// <rkey>_<did>, ordered by the TID the client claimed. those are moved over by
+// MigrateTimeKeys while we run. TIDs won't start with a "d" for centuries, so
+// these legacy keys all sort before every other key space.
+
+var (
+	postsRoot    = []byte("t/")
+	didIndexRoot = []byte("did/")
+)
+
+var (
+	didIndexMigratedKey = []byte("meta/did-index-v1")
+	timeKeysMigratedKey = []byte("meta/time-keys-v1")
+)
+
+// how many keys to write per batch while migrating
+const migrateBatchSize = 10_000
+
+// how many legacy posts to move per batch in the online migration. small, so
+// that the event handlers it holds up don't wait long.
+const moveBatchSize = 500
+
+// postsIterOptions bounds an iterator to just the post keys
+func postsIterOptions() *pebble.IterOptions {
+	return &pebble.IterOptions{
+		LowerBound: postsRoot,
+		UpperBound: prefixUpperBound(postsRoot),
+	}
+}
+
+// legacyPostsIterOptions bounds an iterator to pre-time-ordered post keys
+func legacyPostsIterOptions() *pebble.IterOptions {
+	return &pebble.IterOptions{UpperBound: didIndexRoot}
+}
+
+func postTimePrefix(timeUS int64) []byte {
+	return []byte(fmt.Sprintf("t/%016d/", timeUS))
+}
+
+func postKey(timeUS int64, did, rkey string) []byte {
+	return append(postTimePrefix(timeUS), fmt.Sprintf("%s_%s", rkey, did)...)
+}
+
+func lookupKey(did, rkey string) []byte {
+	return []byte(fmt.Sprintf("k/%s_%s", rkey, did))
+}
+
+func legacyPostKey(did, rkey string) []byte {
+	return []byte(fmt.Sprintf("%s_%s", rkey, did))
+}
+
+func didIndexPrefix(did string) []byte {
+	return []byte(fmt.Sprintf("did/%s/", did))
+}
+
+func didIndexKey(did, rkey string) []byte {
+	return append(didIndexPrefix(did), rkey...)
+}
+
+// parsePostKey splits a post key back into its time, did and rkey
+func parsePostKey(key []byte) (timeUS int64, did, rkey string, ok bool) {
+	rest, found := strings.CutPrefix(string(key), string(postsRoot))
+	if !found {
+		return 0, "", "", false
+	}
+	timePart, id, found := strings.Cut(rest, "/")
+	if !found {
+		return 0, "", "", false
+	}
+	timeUS, err := strconv.ParseInt(timePart, 10, 64)
+	if err != nil {
+		return 0, "", "", false
+	}
+	did, rkey, ok = splitPostId(id)
+	return timeUS, did, rkey, ok
+}
+
+// parseLegacyPostKey splits a pre-time-ordered post key into its did and rkey
+func parseLegacyPostKey(key []byte) (did, rkey string, ok bool) {
+	return splitPostId(string(key))
+}
+
+// splitPostId splits <rkey>_<did>. rkeys can have underscores, but the dids
+// we see (plc and web) can't, so it's the last one.
+func splitPostId(id string) (did, rkey string, ok bool) {
+	i := strings.LastIndex(id, "_")
+	if i < 0 {
+		return "", "", false
+	}
+	return id[i+1:], id[:i], true
+}
+
+// prefixUpperBound is the smallest key greater than every key with prefix
+func prefixUpperBound(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] = end[i] + 1
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil // no upper bound
+}
+
+func (h *PostHandler) PersistEvent(did, rkey string, post PersistedPost) error {
+	defer observeCacheOp("persist", time.Now())
+
+	data, err := json.Marshal(&post)
+	if err != nil {
+		return fmt.Errorf("failed to marshal post to entry: %#v", err)
+	}
+
+	key := postKey(post.TimeUS, did, rkey)
+	batch := h.DB.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(key, data, nil); err != nil {
+		return fmt.Errorf("failed to add event to batch: %#v", err)
+	}
+	if err := batch.Set(lookupKey(did, rkey), key, nil); err != nil {
+		return fmt.Errorf("failed to add lookup to batch: %#v", err)
+	}
+	if err := batch.Set(didIndexKey(did, rkey), nil, nil); err != nil {
+		return fmt.Errorf("failed to add did index to batch: %#v", err)
+	}
+
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return fmt.Errorf("failed to write event to pebble: %#v", err)
+	}
+	return nil
+}
+
+// getCopy is DB.Get for values that need to outlive the closer
+func (h *PostHandler) getCopy(key []byte) ([]byte, error) {
+	value, closer, err := h.DB.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return append([]byte{}, value...), nil
+}
+
+// findPost gets the post key and data for a post, or pebble.ErrNotFound
+func (h *PostHandler) findPost(did, rkey string) (key []byte, data []byte, err error) {
+	key, err = h.getCopy(lookupKey(did, rkey))
+	if err == pebble.ErrNotFound && h.legacy.Load() {
+		key = legacyPostKey(did, rkey)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	data, err = h.getCopy(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, data, nil
+}
+
+// deletePost adds deletes for a post and all its index entries to batch
+func deletePost(batch *pebble.Batch, key []byte, did, rkey string) error {
+	if err := batch.Delete(key, nil); err != nil {
+		return err
+	}
+	if err := batch.Delete(lookupKey(did, rkey), nil); err != nil {
+		return err
+	}
+	return batch.Delete(didIndexKey(did, rkey), nil)
+}
+
+func (h *PostHandler) TakeEvent(did, rkey string) (*PersistedPost, error) {
+	defer observeCacheOp("take", time.Now())
+
+	if h.legacy.Load() {
+		h.legacyLock.RLock()
+		defer h.legacyLock.RUnlock()
+	}
+
+	key, data, err := h.findPost(did, rkey)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := h.DB.NewBatch()
+	defer batch.Close()
+	if err := deletePost(batch, key, did, rkey); err != nil {
+		return nil, err
+	}
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return nil, err
+	}
+	return DecodePost(data)
+}
+
+// GetEvent looks up a post without taking it out of the cache
+func (h *PostHandler) GetEvent(did, rkey string) (*PersistedPost, error) {
+	_, data, err := h.findPost(did, rkey)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePost(data)
+}
+
+// DecodePost reads a cached post's value
+func DecodePost(data []byte) (*PersistedPost, error) {
+	var p PersistedPost
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal from pebble: %#v", err)
+	}
+	return &p, nil
+}
+
+// PurgeAccount drops every cached post for an account (and its index
+// entries) without broadcasting them. returns how many posts were removed.
+func (h *PostHandler) PurgeAccount(did string) (int, error) {
+	if h.legacy.Load() {
+		h.legacyLock.RLock()
+		defer h.legacyLock.RUnlock()
+	}
+
+	prefix := didIndexPrefix(did)
+	iter, err := h.DB.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get did index iter: %#v", err)
+	}
+
+	batch := h.DB.NewBatch()
+	defer batch.Close()
+
+	purged := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		rkey := string(iter.Key()[len(prefix):])
+		key, _, err := h.findPost(did, rkey)
+		if err == pebble.ErrNotFound {
+			// dangling index entry: still clean it up
+			key = legacyPostKey(did, rkey)
+		} else if err != nil {
+			iter.Close()
+			return 0, err
+		} else {
+			purged += 1
+		}
+		if err := deletePost(batch, key, did, rkey); err != nil {
+			iter.Close()
+			return 0, err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return 0, fmt.Errorf("failed to commit account purge: %#v", err)
+	}
+	return purged, nil
+}
+
+// oldestTimeUS finds the event time of the oldest cached post
+func (h *PostHandler) oldestTimeUS() (int64, bool, error) {
+	iter, err := h.DB.NewIter(postsIterOptions())
+	if err != nil {
+		return 0, false, err
+	}
+	var oldest int64
+	var found bool
+	if iter.First() {
+		oldest, _, _, found = parsePostKey(iter.Key())
+	}
+	if err := iter.Close(); err != nil {
+		return 0, false, err
+	}
+
+	if h.legacy.Load() {
+		iter, err := h.DB.NewIter(legacyPostsIterOptions())
+		if err != nil {
+			return 0, false, err
+		}
+		if iter.First() {
+			var p PersistedPost
+			if err := json.Unmarshal(iter.Value(), &p); err == nil && (!found || p.TimeUS < oldest) {
+				oldest, found = p.TimeUS, true
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	return oldest, found, nil
+}
+
+func (h *PostHandler) TrimEvents(ctx context.Context) error {
+	defer observeCacheOp("trim", time.Now())
+
+	// register the oldest event pre-trim: how  much we are overshooting
+	oldest, found, err := h.oldestTimeUS()
+	if err != nil {
+		return err
+	}
+	if found {
+		dt := time.Since(time.UnixMicro(oldest))
+		postCacheDepth.Set(dt.Seconds())
+	} else {
+		log.Printf("nothing in db to set cache depth gauge from")
+	}
+
+	// Keys are prefixed with the event time in microseconds
+	// We can range delete events older than the event TTL
+	return h.TrimBefore(time.Now().Add(-h.Retention.Retention()))
+}
+
+// TrimBefore drops every post that jetstream saw before trimUntil
+func (h *PostHandler) TrimBefore(trimUntil time.Time) error {
+	trimKey := postTimePrefix(trimUntil.UnixMicro())
+
+	batch := h.DB.NewBatch()
+	defer batch.Close()
+
+	// the lookup and did index can't be range-deleted, so drop their entries
+	// one by one
+	iter, err := h.DB.NewIter(&pebble.IterOptions{
+		LowerBound: postsRoot,
+		UpperBound: trimKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get old events iter: %#v", err)
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, did, rkey, ok := parsePostKey(iter.Key())
+		if !ok {
+			continue
+		}
+		if err := deletePost(batch, iter.Key(), did, rkey); err != nil {
+			iter.Close()
+			return fmt.Errorf("failed to unindex old events: %#v", err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if err := batch.DeleteRange(postsRoot, trimKey, nil); err != nil {
+		return fmt.Errorf("failed to add old events range delete to batch: %#v", err)
+	}
+
+	// a lost trim is just redone next time
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		log.Printf("no, bad, failed to delete %s", err)
+		return fmt.Errorf("failed to delete old events: %#v", err)
+	}
+
+	return nil
+}
+
+// MigrateDidIndex builds the did index for a cache written before it existed.
+// it only runs once: a marker key is written when it's done.
+//
+// the did index predates the time-ordered layout, so this only ever has
+// legacy post keys to index.
+func MigrateDidIndex(db *pebble.DB) error {
+	_, closer, err := db.Get(didIndexMigratedKey)
+	if err == nil {
+		closer.Close()
+		return nil // already done
+	} else if err != pebble.ErrNotFound {
+		return fmt.Errorf("failed to check did index migration: %#v", err)
+	}
+
+	log.Println("building did index for existing posts...")
+	iter, err := db.NewIter(legacyPostsIterOptions())
+	if err != nil {
+		return fmt.Errorf("failed to get post keys iter: %#v", err)
+	}
+	defer iter.Close()
+
+	batch := db.NewBatch()
+	indexed := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		did, rkey, ok := parseLegacyPostKey(iter.Key())
+		if !ok {
+			continue
+		}
+		if err := batch.Set(didIndexKey(did, rkey), nil, nil); err != nil {
+			batch.Close()
+			return err
+		}
+		indexed += 1
+		if batch.Count() >= migrateBatchSize {
+			err := batch.Commit(pebble.NoSync)
+			batch.Close()
+			if err != nil {
+				return fmt.Errorf("failed to commit did index batch: %#v", err)
+			}
+			batch = db.NewBatch()
+		}
+	}
+
+	// the marker goes in with the last batch
+	defer batch.Close()
+	if err := batch.Set(didIndexMigratedKey, []byte("1"), nil); err != nil {
+		return err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return fmt.Errorf("failed to commit did index batch: %#v", err)
+	}
+	log.Printf("did index built for %d posts\n", indexed)
+	return nil
+}
+
+// NeedsTimeKeysMigration checks for the marker left by MigrateTimeKeys, and
+// sets up reads to fall back to legacy keys until it's done.
+func (h *PostHandler) NeedsTimeKeysMigration() (bool, error) {
+	_, closer, err := h.DB.Get(timeKeysMigratedKey)
+	if err == nil {
+		closer.Close()
+		return false, nil
+	} else if err != pebble.ErrNotFound {
+		return false, fmt.Errorf("failed to check time keys migration: %#v", err)
+	}
+	h.legacy.Store(true)
+	return true, nil
+}
+
+// MigrateTimeKeys moves legacy <rkey>_<did> posts over to the time-ordered
+// layout. it runs online: events keep being handled while it goes, a small
+// batch at a time.
+func (h *PostHandler) MigrateTimeKeys() error {
+	log.Println("moving posts to time-ordered keys...")
+	moved := 0
+	for {
+		n, err := h.moveLegacyBatch()
+		if err != nil {
+			return err
+		}
+		moved += n
+		if n == 0 {
+			break
+		}
+	}
+
+	if err := h.DB.Set(timeKeysMigratedKey, []byte("1"), pebble.Sync); err != nil {
+		return fmt.Errorf("failed to mark time keys migration done: %#v", err)
+	}
+	h.legacy.Store(false)
+	log.Printf("moved %d posts to time-ordered keys\n", moved)
+	return nil
+}
+
+func (h *PostHandler) moveLegacyBatch() (int, error) {
+	// hold off readers so that nothing can take a post between us reading and
+	// moving it. the iterator is opened under the lock so it sees the same.
+	h.legacyLock.Lock()
+	defer h.legacyLock.Unlock()
+
+	iter, err := h.DB.NewIter(legacyPostsIterOptions())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get legacy posts iter: %#v", err)
+	}
+	defer iter.Close()
+
+	batch := h.DB.NewBatch()
+	defer batch.Close()
+
+	moved := 0
+	for iter.First(); iter.Valid() && moved < moveBatchSize; iter.Next() {
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return 0, err
+		}
+		moved += 1
+
+		did, rkey, ok := parseLegacyPostKey(iter.Key())
+		var p PersistedPost
+		if !ok || json.Unmarshal(iter.Value(), &p) != nil {
+			continue // nothing we can do with it: just drop it
+		}
+		key := postKey(p.TimeUS, did, rkey)
+		if err := batch.Set(key, iter.Value(), nil); err != nil {
+			return 0, err
+		}
+		if err := batch.Set(lookupKey(did, rkey), key, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	if moved == 0 {
+		return 0, nil
+	}
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return 0, fmt.Errorf("failed to commit moved posts: %#v", err)
+	}
+	return moved, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+	"time"
+)
+
+func memHandler(t *testing.T) *PostHandler {
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatalf("failed to open in-memory db: %#v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &PostHandler{
+		DB:        db,
+		Retention: NewRetentionController(0, time.Hour, 48*time.Hour),
+	}
+}
+
+func mustExist(t *testing.T, h *PostHandler, key []byte, message string) {
+	_, closer, err := h.DB.Get(key)
+	if err != nil {
+		t.Fatalf("%s: %#v", message, err)
+	}
+	closer.Close()
+}
+
+func mustNotExist(t *testing.T, h *PostHandler, key []byte, message string) {
+	_, closer, err := h.DB.Get(key)
+	if err == nil {
+		closer.Close()
+	}
+	if err != pebble.ErrNotFound {
+		t.Fatalf("%s: %#v", message, err)
+	}
+}
+
+func TestPurgeAccount(t *testing.T) {
+	h := memHandler(t)
+	h.PersistEvent("did:plc:a", "3lbb2ddbbn22c", PersistedPost{TimeUS: 1, Text: "one"})
+	h.PersistEvent("did:plc:a", "3lbb2ddbbn22d", PersistedPost{TimeUS: 2, Text: "two"})
+	h.PersistEvent("did:plc:ab", "3lbb2ddbbn22e", PersistedPost{TimeUS: 3, Text: "other"})
+
+	purged, err := h.PurgeAccount("did:plc:a")
+	if err != nil {
+		t.Fatalf("purge failed: %#v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("expected two posts purged, got %d", purged)
+	}
+	if _, err := h.TakeEvent("did:plc:a", "3lbb2ddbbn22c"); err != pebble.ErrNotFound {
+		t.Fatalf("purged post should be gone, got %#v", err)
+	}
+	mustNotExist(t, h, postKey(1, "did:plc:a", "3lbb2ddbbn22c"), "purged post key should be gone")
+	if _, err := h.TakeEvent("did:plc:ab", "3lbb2ddbbn22e"); err != nil {
+		t.Fatalf("other account's post should remain, got %#v", err)
+	}
+}
+
+func TestTakeEvent(t *testing.T) {
+	h := memHandler(t)
+	h.PersistEvent("did:plc:a", "not-a-tid", PersistedPost{TimeUS: 12, Text: "hi"})
+
+	post, err := h.TakeEvent("did:plc:a", "not-a-tid")
+	if err != nil {
+		t.Fatalf("take failed: %#v", err)
+	}
+	if post.Text != "hi" || post.TimeUS != 12 {
+		t.Fatalf("took the wrong post: %#v", post)
+	}
+	mustNotExist(t, h, postKey(12, "did:plc:a", "not-a-tid"), "taken post should be gone")
+	mustNotExist(t, h, lookupKey("did:plc:a", "not-a-tid"), "taken post should be unlooked-up")
+	mustNotExist(t, h, didIndexKey("did:plc:a", "not-a-tid"), "taken post should be unindexed")
+}
+
+func TestTrimUnindexes(t *testing.T) {
+	h := memHandler(t)
+	// the rkeys lie about their age: only the event time should matter
+	h.PersistEvent("did:plc:a", "3zzzzzzzzzzzz", PersistedPost{TimeUS: 1, Text: "old"})
+	recent := time.Now().UnixMicro()
+	h.PersistEvent("did:plc:a", "2222222222222", PersistedPost{TimeUS: recent, Text: "new"})
+
+	if err := h.TrimEvents(nil); err != nil {
+		t.Fatalf("trim failed: %#v", err)
+	}
+	mustNotExist(t, h, postKey(1, "did:plc:a", "3zzzzzzzzzzzz"), "old post should be trimmed")
+	mustNotExist(t, h, lookupKey("did:plc:a", "3zzzzzzzzzzzz"), "trimmed post should be unlooked-up")
+	mustNotExist(t, h, didIndexKey("did:plc:a", "3zzzzzzzzzzzz"), "trimmed post should be unindexed")
+	mustExist(t, h, postKey(recent, "did:plc:a", "2222222222222"), "recent post should stay")
+	mustExist(t, h, didIndexKey("did:plc:a", "2222222222222"), "recent post should stay indexed")
+}
+
+func TestPostKeysWithUnderscores(t *testing.T) {
+	h := memHandler(t)
+	h.PersistEvent("did:plc:a", "self_intro_2", PersistedPost{TimeUS: 1, Text: "old"})
+
+	timeUS, did, rkey, ok := parsePostKey(postKey(1, "did:plc:a", "self_intro_2"))
+	if !ok || timeUS != 1 || did != "did:plc:a" || rkey != "self_intro_2" {
+		t.Fatalf("unexpected parse %d %#v %#v %v", timeUS, did, rkey, ok)
+	}
+	did, rkey, ok = parseLegacyPostKey(legacyPostKey("did:web:example.com", "a_b"))
+	if !ok || did != "did:web:example.com" || rkey != "a_b" {
+		t.Fatalf("unexpected legacy parse %#v %#v %v", did, rkey, ok)
+	}
+
+	if err := h.TrimBefore(time.UnixMicro(2)); err != nil {
+		t.Fatalf("trim failed: %#v", err)
+	}
+	mustNotExist(t, h, lookupKey("did:plc:a", "self_intro_2"), "trimmed post should be unlooked-up")
+	mustNotExist(t, h, didIndexKey("did:plc:a", "self_intro_2"), "trimmed post should be unindexed")
+}
+
+func TestMigrateDidIndex(t *testing.T) {
+	h := memHandler(t)
+	// a post written before the index existed
+	h.DB.Set(legacyPostKey("did:plc:a", "3lbb2ddbbn22c"), []byte(`{"Text":"legacy"}`), nil)
+
+	if err := MigrateDidIndex(h.DB); err != nil {
+		t.Fatalf("migration failed: %#v", err)
+	}
+	mustExist(t, h, didIndexKey("did:plc:a", "3lbb2ddbbn22c"), "legacy post should be indexed")
+	if err := MigrateDidIndex(h.DB); err != nil {
+		t.Fatalf("re-running the migration should be a no-op, got %#v", err)
+	}
+}
+
+func TestMigrateTimeKeys(t *testing.T) {
+	h := memHandler(t)
+	// posts written before the time-ordered layout
+	h.DB.Set(legacyPostKey("did:plc:a", "3lbb2ddbbn22c"), []byte(`{"TimeUS":5,"Text":"one"}`), nil)
+	h.DB.Set(legacyPostKey("did:plc:a", "3lbb2ddbbn22d"), []byte(`{"TimeUS":6,"Text":"two"}`), nil)
+	if err := MigrateDidIndex(h.DB); err != nil {
+		t.Fatalf("did index migration failed: %#v", err)
+	}
+
+	needed, err := h.NeedsTimeKeysMigration()
+	if err != nil || !needed {
+		t.Fatalf("legacy cache should need migrating, got %v %#v", needed, err)
+	}
+	// reads work before the move
+	if post, err := h.TakeEvent("did:plc:a", "3lbb2ddbbn22c"); err != nil || post.Text != "one" {
+		t.Fatalf("legacy post should be found while migrating, got %#v %#v", post, err)
+	}
+	mustNotExist(t, h, didIndexKey("did:plc:a", "3lbb2ddbbn22c"), "taken legacy post should be unindexed")
+
+	if err := h.MigrateTimeKeys(); err != nil {
+		t.Fatalf("migration failed: %#v", err)
+	}
+	mustNotExist(t, h, legacyPostKey("did:plc:a", "3lbb2ddbbn22d"), "legacy key should be moved")
+	mustExist(t, h, postKey(6, "did:plc:a", "3lbb2ddbbn22d"), "post should be at its time key")
+	if post, err := h.TakeEvent("did:plc:a", "3lbb2ddbbn22d"); err != nil || post.Text != "two" {
+		t.Fatalf("moved post should be found, got %#v %#v", post, err)
+	}
+
+	needed, err = h.NeedsTimeKeysMigration()
+	if err != nil || needed {
+		t.Fatalf("migrated cache shouldn't need migrating again, got %v %#v", needed, err)
+	}
+}
+
+func TestPebbleCollector(t *testing.T) {
+	h := memHandler(t)
+	h.PersistEvent("did:plc:a", "3lbb2ddbbn22c", PersistedPost{TimeUS: 1, Text: "one"})
+	h.DB.Flush()
+
+	registry := prometheus.NewPedanticRegistry()
+	collector := NewPebbleCollector(h.DB)
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather pebble metrics: %#v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "pebble_keys_estimate" {
+			t.Fatalf("expected no key estimate until it's counted")
+		}
+	}
+
+	if err := collector.RefreshKeys(); err != nil {
+		t.Fatalf("failed to count keys: %#v", err)
+	}
+	families, err = registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather pebble metrics: %#v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "pebble_keys_estimate" {
+			if keys := family.GetMetric()[0].GetGauge().GetValue(); keys != 3 {
+				t.Fatalf("expected a post, its lookup and its index entry, got %v keys", keys)
+			}
+			return
+		}
+	}
+	t.Fatalf("no key estimate gathered")
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const cacheUsage = `usage: %s cache <command> [flags] [args]
+
+offline tools for the post cache. pebble locks the db, so stop the server
+first (or point --db at a copy). stats, get, dump and verify only read it;
+the others migrate it first, like the server does on startup.
+
+commands:
+  stats                 count, oldest/newest, and size by language and target
+  get <did> <rkey>      print one cached post
+  dump [--since T]      print cached posts as ndjson
+  trim --before T       drop posts jetstream saw before T
+  compact               compact the whole db, reclaiming trimmed space
+  verify                find keys and values that can't be decoded
+  snapshot              write a snapshot archive to stdout (see RESTORE_FROM)
+
+T is either an RFC 3339 time or a duration ago, like 6h.
+`
+
+// cacheCommands are the subcommands, and whether they only read the db.
+// read-only commands don't migrate: they see the cache as it is.
+var cacheCommands = map[string]bool{
+	"stats":    true,
+	"get":      true,
+	"dump":     true,
+	"trim":     false,
+	"compact":  false,
+	"verify":   true,
+	"snapshot": false,
+}
+
+// CacheCommand runs a `cache` subcommand and returns the exit code
+func CacheCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, cacheUsage, os.Args[0])
+		return 2
+	}
+	command, args := args[0], args[1:]
+	readOnly, ok := cacheCommands[command]
+	if !ok {
+		fmt.Fprintf(stderr, cacheUsage, os.Args[0])
+		return 2
+	}
+
+	flags := flag.NewFlagSet("cache "+command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "./posts-cache.db"
+	}
+	flags.StringVar(&dbPath, "db", dbPath, "path to the pebble db (default from DB_PATH)")
+	since := flags.String("since", "", "dump: only posts seen after this time")
+	before := flags.String("before", "", "trim: drop posts seen before this time")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// check everything before touching the db
+	usageError := ""
+	flags.Visit(func(f *flag.Flag) {
+		if (f.Name == "since" && command != "dump") || (f.Name == "before" && command != "trim") {
+			usageError = fmt.Sprintf("--%s isn't for cache %s", f.Name, command)
+		}
+	})
+	if command == "get" && flags.NArg() != 2 {
+		usageError = "usage: cache get <did> <rkey>"
+	} else if command != "get" && flags.NArg() != 0 {
+		usageError = fmt.Sprintf("unexpected arguments for cache %s: %v", command, flags.Args())
+	}
+	if command == "trim" && *before == "" {
+		usageError = "usage: cache trim --before T"
+	}
+	if usageError != "" {
+		fmt.Fprintln(stderr, usageError)
+		return 2
+	}
+	var sinceTime, beforeTime time.Time
+	var err error
+	if *since != "" {
+		if sinceTime, err = parseCliTime(*since); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+	if *before != "" {
+		if beforeTime, err = parseCliTime(*before); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+
+	profile, err := GetStorageProfile(os.Getenv("CACHE_PROFILE"))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	db, err := OpenExistingCache(dbPath, profile, readOnly)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open db: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+	h := &PostHandler{DB: db}
+
+	// reads fall back to legacy keys until they're moved
+	needsTimeKeys, err := h.NeedsTimeKeysMigration()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to check key layout: %s\n", err)
+		return 1
+	}
+	if !readOnly {
+		// the server would do these on startup anyway
+		if err := MigrateDidIndex(db); err != nil {
+			fmt.Fprintf(stderr, "failed to build did index: %s\n", err)
+			return 1
+		}
+		if needsTimeKeys {
+			if err := h.MigrateTimeKeys(); err != nil {
+				fmt.Fprintf(stderr, "failed to migrate to time-ordered keys: %s\n", err)
+				return 1
+			}
+		}
+	}
+
+	switch command {
+	case "stats":
+		err = cacheStats(h, stdout)
+	case "get":
+		err = cacheGet(h, flags.Arg(0), flags.Arg(1), stdout)
+	case "dump":
+		err = cacheDump(h, sinceTime, stdout)
+	case "trim":
+		err = h.TrimBefore(beforeTime)
+	case "compact":
+		err = db.Compact([]byte{0x00}, []byte{0xff}, true)
+	case "verify":
+		var bad int
+		bad, err = cacheVerify(h, stdout)
+		if err == nil && bad > 0 {
+			fmt.Fprintf(stderr, "%d bad entries\n", bad)
+			return 1
+		}
+	case "snapshot":
+		if err = h.LoadCursor(); err == nil {
+			err = h.Snapshot(stdout)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "cache %s failed: %s\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+// parseCliTime takes an RFC 3339 time, or a duration before now
+func parseCliTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC 3339 time or a duration, got %#v", value)
+	}
+	return t, nil
+}
+
+// forEachPost calls fn with every cached post key and value, oldest first
+func forEachPost(db *pebble.DB, lowerBound []byte, fn func(key, value []byte) error) error {
+	opts := postsIterOptions()
+	if lowerBound != nil {
+		opts.LowerBound = lowerBound
+	}
+	return forEachKey(db, opts, fn)
+}
+
+// forEachLegacyPost calls fn with every post still at a legacy <rkey>_<did>
+// key (see MigrateTimeKeys), in rkey order
+func forEachLegacyPost(db *pebble.DB, fn func(key, value []byte) error) error {
+	return forEachKey(db, legacyPostsIterOptions(), fn)
+}
+
+func forEachKey(db *pebble.DB, opts *pebble.IterOptions, fn func(key, value []byte) error) error {
+	iter, err := db.NewIter(opts)
+	if err != nil {
+		return err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := fn(iter.Key(), iter.Value()); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+type sizeStat struct {
+	Posts int
+	Bytes int
+}
+
+func cacheStats(h *PostHandler, w io.Writer) error {
+	var count, bytes int
+	var oldest, newest int64
+	byLang := map[string]*sizeStat{}
+	byTarget := map[string]*sizeStat{}
+	undecodable := 0
+	add := func(post *PersistedPost, size int) {
+		if count == 0 || post.TimeUS < oldest {
+			oldest = post.TimeUS
+		}
+		if count == 0 || post.TimeUS > newest {
+			newest = post.TimeUS
+		}
+		count += 1
+		bytes += size
+		addSizeStat(byLang, post.FirstLang(), size)
+		addSizeStat(byTarget, post.TargetName(), size)
+	}
+
+	err := forEachPost(h.DB, nil, func(key, value []byte) error {
+		_, _, _, ok := parsePostKey(key)
+		post, err := DecodePost(value)
+		if !ok || err != nil {
+			undecodable += 1
+			return nil
+		}
+		add(post, len(key)+len(value))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// legacy posts count everywhere, by their stored time
+	legacy := 0
+	err = forEachLegacyPost(h.DB, func(key, value []byte) error {
+		_, _, ok := parseLegacyPostKey(key)
+		post, err := DecodePost(value)
+		if !ok || err != nil {
+			undecodable += 1
+			return nil
+		}
+		legacy += 1
+		add(post, len(key)+len(value))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics := h.DB.Metrics()
+	fmt.Fprintf(w, "posts:\t%d (%d bytes of keys and values)\n", count, bytes)
+	fmt.Fprintf(w, "disk:\t%d bytes\n", metrics.DiskSpaceUsage())
+	if count > 0 {
+		fmt.Fprintf(w, "oldest:\t%s\n", time.UnixMicro(oldest).UTC().Format(time.RFC3339))
+		fmt.Fprintf(w, "newest:\t%s\n", time.UnixMicro(newest).UTC().Format(time.RFC3339))
+	}
+	if legacy > 0 {
+		fmt.Fprintf(w, "legacy:\t%d of those (not yet moved to time-ordered keys)\n", legacy)
+	}
+	if undecodable > 0 {
+		fmt.Fprintf(w, "undecodable:\t%d (see cache verify)\n", undecodable)
+	}
+	printSizeStats(w, "language", byLang)
+	printSizeStats(w, "target", byTarget)
+	return nil
+}
+
+func addSizeStat(stats map[string]*sizeStat, name string, bytes int) {
+	if stats[name] == nil {
+		stats[name] = &sizeStat{}
+	}
+	stats[name].Posts += 1
+	stats[name].Bytes += bytes
+}
+
+func printSizeStats(w io.Writer, title string, stats map[string]*sizeStat) {
+	names := []string{}
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return stats[names[i]].Posts > stats[names[j]].Posts
+	})
+	fmt.Fprintf(w, "\nby %s:\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%d posts\t%d bytes\n", name, stats[name].Posts, stats[name].Bytes)
+	}
+}
+
+func cacheGet(h *PostHandler, did, rkey string, w io.Writer) error {
+	post, err := h.GetEvent(did, rkey)
+	if err == pebble.ErrNotFound {
+		return fmt.Errorf("no cached post for %s %s", did, rkey)
+	} else if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(post)
+}
+
+type dumpedPost struct {
+	Did  string         `json:"did"`
+	RKey string         `json:"rkey"`
+	Post *PersistedPost `json:"post"`
+}
+
+func cacheDump(h *PostHandler, since time.Time, w io.Writer) error {
+	var lowerBound []byte
+	if !since.IsZero() {
+		lowerBound = postTimePrefix(since.UnixMicro())
+	}
+	encoder := json.NewEncoder(w)
+	// not moved yet, so they're older than the rest
+	err := forEachLegacyPost(h.DB, func(key, value []byte) error {
+		did, rkey, ok := parseLegacyPostKey(key)
+		post, err := DecodePost(value)
+		if !ok || err != nil || post.TimeUS < since.UnixMicro() {
+			return nil
+		}
+		return encoder.Encode(dumpedPost{Did: did, RKey: rkey, Post: post})
+	})
+	if err != nil {
+		return err
+	}
+	return forEachPost(h.DB, lowerBound, func(key, value []byte) error {
+		_, did, rkey, ok := parsePostKey(key)
+		post, err := DecodePost(value)
+		if !ok || err != nil {
+			return nil // cache verify is for finding these
+		}
+		return encoder.Encode(dumpedPost{Did: did, RKey: rkey, Post: post})
+	})
+}
+
+func cacheVerify(h *PostHandler, w io.Writer) (int, error) {
+	checked, bad := 0, 0
+	err := forEachLegacyPost(h.DB, func(key, value []byte) error {
+		checked += 1
+		if _, _, ok := parseLegacyPostKey(key); !ok {
+			bad += 1
+			fmt.Fprintf(w, "bad legacy key %q\n", key)
+			return nil
+		}
+		if _, err := DecodePost(value); err != nil {
+			bad += 1
+			fmt.Fprintf(w, "undecodable legacy value at %q: %s\n", key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return bad, err
+	}
+	err = forEachPost(h.DB, nil, func(key, value []byte) error {
+		checked += 1
+		if _, _, _, ok := parsePostKey(key); !ok {
+			bad += 1
+			fmt.Fprintf(w, "bad key %q\n", key)
+			return nil
+		}
+		if _, err := DecodePost(value); err != nil {
+			bad += 1
+			fmt.Fprintf(w, "undecodable value at %q: %s\n", key, err)
+		}
+		return nil
+	})
+	fmt.Fprintf(w, "checked %d posts\n", checked)
+	return bad, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheCommand(t *testing.T) {
+	dbPath := t.TempDir()
+	db, err := OpenCache(dbPath, storageProfiles["stock"])
+	if err != nil {
+		t.Fatalf("failed to open cache: %#v", err)
+	}
+	h := &PostHandler{DB: db}
+	old := time.Now().Add(-3 * time.Hour).UnixMicro()
+	recent := time.Now().Add(-time.Minute).UnixMicro()
+	h.PersistEvent("did:plc:a", "3lbb2ddbbn22c", PersistedPost{TimeUS: old, Text: "old", Langs: []string{"en"}})
+	h.PersistEvent("did:plc:b", "3lbb2ddbbn22d", PersistedPost{TimeUS: recent, Text: "recent", Langs: []string{"ja"}})
+	db.Close()
+
+	run := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := CacheCommand(append([]string{args[0], "--db", dbPath}, args[1:]...), &stdout, &stderr)
+		return code, stdout.String()
+	}
+
+	if code, out := run("stats"); code != 0 || !strings.Contains(out, "posts:\t2 ") {
+		t.Fatalf("expected stats for two posts, got %d %q", code, out)
+	}
+	if code, out := run("get", "did:plc:b", "3lbb2ddbbn22d"); code != 0 || !strings.Contains(out, `"recent"`) {
+		t.Fatalf("expected to get the recent post, got %d %q", code, out)
+	}
+	if code, _ := run("get", "did:plc:b", "nope"); code != 1 {
+		t.Fatalf("missing posts should fail, got %d", code)
+	}
+	if code, _ := run("trim"); code != 2 {
+		t.Fatalf("trim without --before should be a usage error, got %d", code)
+	}
+	if code, _ := run("trim", "--before", "1h"); code != 0 {
+		t.Fatalf("trim failed: %d", code)
+	}
+
+	code, out := run("dump")
+	if code != 0 {
+		t.Fatalf("dump failed: %d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the recent post after trimming, got %q", out)
+	}
+	var dumped dumpedPost
+	if err := json.Unmarshal([]byte(lines[0]), &dumped); err != nil {
+		t.Fatalf("dump should be ndjson: %#v", err)
+	}
+	if dumped.Did != "did:plc:b" || dumped.RKey != "3lbb2ddbbn22d" || dumped.Post.Text != "recent" {
+		t.Fatalf("unexpected dumped post: %#v", dumped)
+	}
+
+	if code, out := run("verify"); code != 0 || !strings.Contains(out, "checked 1 posts") {
+		t.Fatalf("expected a clean verify, got %d %q", code, out)
+	}
+}
+
+func TestCacheCommandLeavesMissingDbAlone(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "nope.db")
+	for _, args := range [][]string{
+		{"bogus"},
+		{"trim"},
+		{"get", "did:plc:a"},
+		{"stats", "extra"},
+		{"stats", "--before", "1h"},
+		{"dump", "--since", "yesterday-ish"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := CacheCommand(append([]string{args[0], "--db", dbPath}, args[1:]...), &stdout, &stderr); code != 2 {
+			t.Errorf("%v: expected a usage error, got %d", args, code)
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	if code := CacheCommand([]string{"stats", "--db", dbPath}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected a missing db to fail, got %d", code)
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no db to be created, got %#v", err)
+	}
+}
+
+func TestCacheVerifyLegacy(t *testing.T) {
+	dbPath := t.TempDir()
+	db, err := OpenCache(dbPath, storageProfiles["stock"])
+	if err != nil {
+		t.Fatalf("failed to open cache: %#v", err)
+	}
+	db.Set(legacyPostKey("did:plc:a", "3lbb2ddbbn22c"), []byte(`{"TimeUS":5,"Text":"one"}`), nil)
+	db.Set(legacyPostKey("did:plc:a", "3lbb2ddbbn22d"), []byte(`not json`), nil)
+	db.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := CacheCommand([]string{"verify", "--db", dbPath}, &stdout, &stderr)
+	if code != 1 || !strings.Contains(stdout.String(), "undecodable legacy value") || !strings.Contains(stdout.String(), "checked 2 posts") {
+		t.Fatalf("expected the bad legacy post to be reported, got %d %q", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := CacheCommand([]string{"dump", "--db", dbPath}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), `"one"`) {
+		t.Fatalf("expected legacy posts in the dump, got %d %q", code, stdout.String())
+	}
+	stdout.Reset()
+	code = CacheCommand([]string{"stats", "--db", dbPath}, &stdout, &stderr)
+	for _, line := range []string{"posts:\t1 ", "legacy:\t1 ", "oldest:\t1970-01-01T00:00:00Z", "undecodable:\t1 "} {
+		if code != 0 || !strings.Contains(stdout.String(), line) {
+			t.Fatalf("expected legacy posts counted in the stats (%q), got %d %q", line, code, stdout.String())
+		}
+	}
+
+	// read-only commands didn't migrate anything away
+	db, err = OpenCache(dbPath, storageProfiles["stock"])
+	if err != nil {
+		t.Fatalf("failed to open cache: %#v", err)
+	}
+	defer db.Close()
+	if _, closer, err := db.Get(legacyPostKey("did:plc:a", "3lbb2ddbbn22d")); err != nil {
+		t.Fatalf("expected the legacy post to be left alone, got %#v", err)
+	} else {
+		closer.Close()
+	}
+}
@@ -4,22 +4,39 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	apibsky "github.com/bluesky-social/indigo/api/bsky"
-	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/jetstream/pkg/client"
 	"github.com/bluesky-social/jetstream/pkg/client/schedulers/parallel"
 	"github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/cockroachdb/pebble"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/text/unicode/norm"
 	"log"
 	"log/slog"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type PostHandler struct {
 	DB            *pebble.DB
 	DeletedFeed   chan<- LikedPersistedPost
-	LanguagesFeed chan<- []string
+	LanguagesFeed chan<- LangEvent
+	Bulk          *BulkTracker
+	Retention     *RetentionController
+
+	// while legacy keys might still exist (see cache.go), reads have to check
+	// for them and can't interleave with a batch of them being moved
+	legacy     atomic.Bool
+	legacyLock sync.RWMutex
+
+	// newest jetstream event time handled (see snapshot.go)
+	cursor atomic.Int64
+	// events up to here were handled before the last reconnect, and are
+	// coming around again (see ResumeCursor)
+	replayedUntil atomic.Int64
 }
 
 type PostTargetType string
@@ -38,24 +55,29 @@ func MustParseDuration(d string) time.Duration {
 }
 
 var ( // gross: duration can't be const
-	maxRkeyTimeError  time.Duration = MustParseDuration("1h")
-	maxRkeySince      time.Duration = MustParseDuration("25h") // allow backfill: jetstream max retention plus an hour
-	maxPostRetention  time.Duration = MustParseDuration("24h") * 2
 	connectRetryReset time.Duration = MustParseDuration("1m")
 	connectRetryWait  time.Duration = MustParseDuration("3s")
+	bulkDeleteWindow  time.Duration = MustParseDuration("1m")
 )
 
+// deletes from one account within bulkDeleteWindow before they're considered
+// a cascading (bulk) deletion
+const bulkDeleteThreshold = 12
+
 type PersistedPost struct {
 	TimeUS int64
 	Text   string
 	Langs  []string
 	Target *PostTargetType
+	// guessed from the text when Langs is empty (see detect.go)
+	DetectedLangs []string `json:",omitempty"`
 }
 
 type UncoveredPost struct {
 	Post *PersistedPost
 	Did  string
 	RKey string
+	Kind DeletionKind
 }
 
 func (p *PersistedPost) AgeMs(t time.Time) int64 {
@@ -63,13 +85,13 @@ func (p *PersistedPost) AgeMs(t time.Time) int64 {
 }
 
 func (p *PersistedPost) FirstLang() string {
-	// only for metrics: for simplicity we only keep the first language.
-	// posts with no language get the special value "-", which can never occur
-	// in the saved languages after normalization.
+	// only for metrics: for simplicity we only keep the first language, and
+	// only its base language. posts with no language get the special value
+	// "-", which can never occur in the saved languages after normalization.
 	if len(p.Langs) == 0 {
 		return "-"
 	} else {
-		return p.Langs[0]
+		return BaseLang(p.Langs[0])
 	}
 }
 
@@ -81,18 +103,56 @@ func (p *PersistedPost) TargetName() string {
 	}
 }
 
-func Consume(ctx context.Context, env, jsUrl, dbPath string, logger *slog.Logger) (<-chan LikedPersistedPost, <-chan []string) {
+func Consume(ctx context.Context, env, jsUrl, dbPath string, profile StorageProfile, retention *RetentionController, logger *slog.Logger) (*PostHandler, <-chan LikedPersistedPost, <-chan LangEvent) {
 	config := client.DefaultClientConfig()
 	config.WebsocketURL = jsUrl
 	config.Compress = true
 	config.WantedCollections = []string{"app.bsky.feed.post"}
 
-	db, err := pebble.Open(dbPath, &pebble.Options{})
+	db, err := OpenCache(dbPath, profile)
 	if err != nil {
 		log.Fatalf("failed to open db: %#v", err)
 	}
+	collector := NewPebbleCollector(db)
+	prometheus.MustRegister(collector)
+
+	if err := MigrateDidIndex(db); err != nil {
+		log.Fatalf("failed to build did index: %#v", err)
+	}
+
+	deletedFeed := make(chan LikedPersistedPost, 120)
+	languagesFeed := make(chan LangEvent, 2)
+
+	h := &PostHandler{
+		DB:            db,
+		LanguagesFeed: languagesFeed,
+		DeletedFeed:   deletedFeed,
+		Bulk:          NewBulkTracker(bulkDeleteWindow, bulkDeleteThreshold),
+		Retention:     retention,
+	}
+
+	if err := h.LoadCursor(); err != nil {
+		log.Fatalf("failed to load jetstream cursor: %#v", err)
+	}
+
+	needsMigration, err := h.NeedsTimeKeysMigration()
+	if err != nil {
+		log.Fatalf("failed to check key layout: %#v", err)
+	}
+	retention.Hold(needsMigration)
+	if err := retention.Load(db); err != nil {
+		logger.Error("failed to load cache retention, starting over", "error", err)
+	}
+	if needsMigration {
+		go func() {
+			if err := h.MigrateTimeKeys(); err != nil {
+				log.Fatalf("failed to migrate to time-ordered keys: %#v", err)
+			}
+			retention.Hold(false)
+		}()
+	}
 
-	iter, err := db.NewIter(nil)
+	iter, err := db.NewIter(postsIterOptions())
 	if err != nil {
 		log.Fatalf("failed to get db iter: %#v", err)
 	}
@@ -109,15 +169,6 @@ func Consume(ctx context.Context, env, jsUrl, dbPath string, logger *slog.Logger
 		log.Fatalf("failed to close iterator: %s", err)
 	}
 
-	deletedFeed := make(chan LikedPersistedPost, 120)
-	languagesFeed := make(chan []string, 2)
-
-	h := &PostHandler{
-		DB:            db,
-		LanguagesFeed: languagesFeed,
-		DeletedFeed:   deletedFeed,
-	}
-
 	scheduler := parallel.NewScheduler(21, "asdf", logger, h.HandleEvent)
 
 	c, err := client.NewClient(config, logger, scheduler)
@@ -126,10 +177,33 @@ func Consume(ctx context.Context, env, jsUrl, dbPath string, logger *slog.Logger
 	}
 
 	go func() {
-		trimTicker := time.NewTicker(8 * time.Second)
-		for range trimTicker.C {
-			if err := h.TrimEvents(ctx); err != nil {
-				logger.Error("failed to trim events", "error", err)
+		adjustTicker := time.NewTicker(retentionAdjustInterval)
+		trimTimer := time.NewTimer(retention.TrimInterval())
+		keysTicker := time.NewTicker(pebbleKeysRefresh)
+		if err := collector.RefreshKeys(); err != nil {
+			logger.Error("failed to count pebble keys", "error", err)
+		}
+		for {
+			select {
+			case <-keysTicker.C:
+				if err := collector.RefreshKeys(); err != nil {
+					logger.Error("failed to count pebble keys", "error", err)
+				}
+			case <-adjustTicker.C:
+				metrics := h.DB.Metrics()
+				retention.Adjust(metrics.DiskSpaceUsage())
+				if err := retention.Save(h.DB, pebble.NoSync); err != nil {
+					logger.Error("failed to save cache retention", "error", err)
+				}
+				if err := h.SaveCursor(pebble.NoSync); err != nil {
+					logger.Error("failed to save jetstream cursor", "error", err)
+				}
+			case <-trimTimer.C:
+				if err := h.TrimEvents(ctx); err != nil {
+					logger.Error("failed to trim events", "error", err)
+				}
+				h.Bulk.Sweep(time.Now())
+				trimTimer.Reset(retention.TrimInterval())
 			}
 		}
 	}()
@@ -140,16 +214,20 @@ func Consume(ctx context.Context, env, jsUrl, dbPath string, logger *slog.Logger
 		var retry = 0
 		var lastConnect = time.Now()
 		for {
-			if err := c.ConnectAndRead(ctx, nil); err != nil {
+			cursor := h.ResumeCursor()
+			if cursor != nil {
+				logger.Info("resuming jetstream", "cursor", *cursor)
+			}
+			if err := c.ConnectAndRead(ctx, cursor); err != nil {
 				if time.Since(lastConnect) >= connectRetryReset {
 					retry = 0
-					logger.Info("jetstream connection ended with error, will retry", err)
+					logger.Info("jetstream connection ended with error, will retry", "error", err)
 				} else {
 					retry += 1
 					if retry >= 14 {
-						log.Fatalf("jetstream: connection ended with error and no more retries. exiting", err)
+						log.Fatalf("jetstream: connection ended with error and no more retries. exiting: %s", err)
 					} else {
-						logger.Info("jetstream connection ended with error", err, "retry:", retry)
+						logger.Info("jetstream connection ended with error", "error", err, "retry", retry)
 					}
 				}
 				time.Sleep(connectRetryWait)
@@ -162,26 +240,18 @@ func Consume(ctx context.Context, env, jsUrl, dbPath string, logger *slog.Logger
 		logger.Info("gbyeee from jetstream")
 	}()
 
-	return deletedFeed, languagesFeed
-}
-
-func PostKey(event *models.Event) ([]byte, error) {
-	if event.Kind == models.EventKindCommit && event.Commit != nil && event.Commit.Collection == "app.bsky.feed.post" {
-		return []byte(fmt.Sprintf("%s_%s", event.Commit.RKey, event.Did)), nil
-	} else {
-		return nil, fmt.Errorf("failed to generate key for persisting event: not a valid bsky post commit event")
-	}
+	return h, deletedFeed, languagesFeed
 }
 
-func (h *PostHandler) handlePersistPost(key []byte, post apibsky.FeedPost, time int64) error {
+func (h *PostHandler) handlePersistPost(did, rkey string, post apibsky.FeedPost, timeUS int64) error {
 	redacted := Redact(post.Text, post.Facets)
-	redacted = strings.TrimSpace(redacted)
+	redacted = norm.NFC.String(strings.TrimSpace(redacted))
 	if redacted == "" { // drop empty posts (and updates that become empty)
 		return nil
 	}
 
 	langs := NormalizeLangs(post.Langs)
-	h.LanguagesFeed <- langs
+	h.LanguagesFeed <- LangEvent{Langs: langs, At: time.UnixMicro(timeUS)}
 
 	var target *PostTargetType = nil
 	if post.Reply != nil {
@@ -193,13 +263,16 @@ func (h *PostHandler) handlePersistPost(key []byte, post apibsky.FeedPost, time
 	}
 
 	persistable := PersistedPost{
-		TimeUS: time,
+		TimeUS: timeUS,
 		Text:   redacted,
 		Langs:  langs,
 		Target: target,
 	}
+	if len(langs) == 0 {
+		persistable.DetectedLangs = DetectLangs(redacted)
+	}
 
-	if err := h.PersistEvent(key, persistable); err != nil {
+	if err := h.PersistEvent(did, rkey, persistable); err != nil {
 		return fmt.Errorf("failed to persist post: %#v", err)
 	}
 
@@ -208,8 +281,39 @@ func (h *PostHandler) handlePersistPost(key []byte, post apibsky.FeedPost, time
 	return nil
 }
 
+func (h *PostHandler) handleAccount(account *comatproto.SyncSubscribeRepos_Account) error {
+	if account.Active {
+		accountEventCounter.WithLabelValues("active", "ignored").Inc()
+		return nil
+	}
+
+	status := "inactive"
+	if account.Status != nil {
+		status = *account.Status
+	}
+
+	// the account is gone (deleted, deactivated, taken down...): they left,
+	// they didn't delete their posts, so their posts are dropped quietly.
+	purged, err := h.PurgeAccount(account.Did)
+	if err != nil {
+		accountEventCounter.WithLabelValues(status, "failed").Inc()
+		return fmt.Errorf("failed to purge account posts: %#v", err)
+	}
+	accountEventCounter.WithLabelValues(status, "purged").Inc()
+	accountPostsPurgedCounter.WithLabelValues(status).Add(float64(purged))
+	return nil
+}
+
 func (h *PostHandler) HandleEvent(ctx context.Context, event *models.Event) error {
 
+	// jetstream sends account and identity events regardless of
+	// WantedCollections
+	if event.Kind == models.EventKindAccount && event.Account != nil {
+		h.observeCursor(event.TimeUS)
+		return h.handleAccount(event.Account)
+	}
+	h.observeCursor(event.TimeUS)
+
 	if !(event.Kind == models.EventKindCommit &&
 		event.Commit != nil &&
 		event.Commit.Collection == "app.bsky.feed.post") {
@@ -217,29 +321,7 @@ func (h *PostHandler) HandleEvent(ctx context.Context, event *models.Event) erro
 		return nil
 	}
 
-	if event.Commit.Operation == models.CommitOperationCreate {
-		parsed, err := syntax.ParseTID(event.Commit.RKey)
-		if err != nil {
-			skippedPostCounter.WithLabelValues("TID failed to parse from rkey").Inc()
-			return nil
-		}
-		rkeyTime := parsed.Time()
-
-		eventTime := time.UnixMicro(event.TimeUS)
-		timeError := rkeyTime.Sub(eventTime).Abs()
-		if timeError > maxRkeyTimeError {
-			skippedPostCounter.WithLabelValues("TID from rkey too far from event time").Inc()
-			return nil
-		}
-
-		since := time.Since(rkeyTime).Abs()
-		if since > maxRkeySince {
-			skippedPostCounter.WithLabelValues("TID from rkey too far from now").Inc()
-			return nil
-		}
-	}
-
-	key := []byte(fmt.Sprintf("%s_%s", event.Commit.RKey, event.Did))
+	did, rkey := event.Did, event.Commit.RKey
 
 	if event.Commit.Operation == models.CommitOperationCreate || event.Commit.Operation == models.CommitOperationUpdate {
 		var post apibsky.FeedPost
@@ -250,7 +332,7 @@ func (h *PostHandler) HandleEvent(ctx context.Context, event *models.Event) erro
 
 		postTime := event.TimeUS
 		if event.Commit.Operation == models.CommitOperationUpdate {
-			existing, err := h.TakeEvent(key)
+			existing, err := h.TakeEvent(did, rkey)
 			if err != nil {
 				if err == pebble.ErrNotFound {
 					// cache miss: ignore
@@ -267,13 +349,16 @@ func (h *PostHandler) HandleEvent(ctx context.Context, event *models.Event) erro
 			postTime = existing.TimeUS
 		}
 
-		if err := h.handlePersistPost(key, post, postTime); err != nil {
+		if err := h.handlePersistPost(did, rkey, post, postTime); err != nil {
 			skippedPostCounter.WithLabelValues("persisting failed").Inc()
 			return err
 		}
 		return nil
 	} else if event.Commit.Operation == models.CommitOperationDelete {
-		post, err := h.TakeEvent(key)
+		kind := h.Bulk.Observe(did, time.UnixMicro(event.TimeUS))
+		postDeleteKindCounter.WithLabelValues(string(kind)).Inc()
+
+		post, err := h.TakeEvent(did, rkey)
 		if err != nil {
 			if err == pebble.ErrNotFound { // cache miss: ignore
 				postDeleteCounter.WithLabelValues("-", "-", "miss").Inc()
@@ -282,11 +367,17 @@ func (h *PostHandler) HandleEvent(ctx context.Context, event *models.Event) erro
 				return err
 			}
 		}
-		if post != nil {
+		// replayed deletes update the cache, but aren't news to observers, or
+		// to the language stats' current window
+		if post != nil && h.Replayed(event.TimeUS) {
+			postDeleteCounter.WithLabelValues(post.FirstLang(), post.TargetName(), "replayed").Inc()
+		} else if post != nil {
+			h.LanguagesFeed <- LangEvent{Langs: post.Langs, Deleted: true, At: time.UnixMicro(event.TimeUS)}
 			uncovered := UncoveredPost{
 				Post: post,
-				Did:  event.Did,
-				RKey: event.Commit.RKey,
+				Did:  did,
+				RKey: rkey,
+				Kind: kind,
 			}
 			liked := GetLikes(uncovered)
 			select {
@@ -300,70 +391,3 @@ func (h *PostHandler) HandleEvent(ctx context.Context, event *models.Event) erro
 	}
 	return nil
 }
-
-func (h *PostHandler) PersistEvent(key []byte, post PersistedPost) error {
-	data, err := json.Marshal(&post)
-	if err != nil {
-		return fmt.Errorf("failed to marshal post to entry: %#v", err)
-	}
-
-	err = h.DB.Set(key, data, pebble.NoSync)
-	if err != nil {
-		fmt.Printf("failed to write event to pebble: %#v", err)
-		return fmt.Errorf("failed to write event to pebble: %#v", err)
-	}
-	return nil
-}
-
-func (h *PostHandler) TakeEvent(key []byte) (*PersistedPost, error) {
-	data, closer, err := h.DB.Get(key)
-	if err != nil {
-		return nil, err
-	}
-	defer closer.Close()
-	if err := h.DB.Delete(key, pebble.NoSync); err != nil {
-		return nil, err
-	}
-	var p PersistedPost
-	err = json.Unmarshal(data, &p)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal from pebble: %#v", err)
-	}
-	return &p, nil
-}
-
-func (h *PostHandler) TrimEvents(ctx context.Context) error {
-
-	// register the oldest event pre-trim: how  much we are overshooting
-	iter, err := h.DB.NewIter(nil)
-	if err != nil {
-		log.Fatalf("failed to get db iter: %#v", err)
-	}
-	if iter.First() {
-		var p PersistedPost
-		if err := json.Unmarshal(iter.Value(), &p); err != nil {
-			log.Fatalf("failed to read latest entry: %#v", err)
-		}
-		dt := time.Since(time.UnixMicro(p.TimeUS))
-		postCacheDepth.Set(dt.Seconds())
-	} else {
-		log.Printf("nothing in db to set cache depth gauge from")
-	}
-	if err := iter.Close(); err != nil {
-		return err
-	}
-
-	// Keys are stored as strings of the event time in microseconds
-	// We can range delete events older than the event TTL
-	trimUntil := time.Now().Add(-maxPostRetention)
-	trimUntilRkey := syntax.NewTID(trimUntil.UnixMicro(), 0)
-	trimKey := []byte(trimUntilRkey.String())
-
-	// Delete all numeric keys older than the trim key
-	if err := h.DB.DeleteRange([]byte("0"), trimKey, pebble.Sync); err != nil {
-		log.Printf("no, bad, failed to delete %s", err)
-		return fmt.Errorf("failed to delete old events: %#v", err)
-	}
-
-	return nil
-}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/abadojack/whatlanggo"
+	"strings"
+	"unicode/utf8"
+)
+
+// lots of posts don't say what language they're in. for those we guess from
+// the text, offline, and keep the guess apart from what authors declare: see
+// PersistedPost.DetectedLangs and ObserverFilter.Detected.
+
+// shorter texts don't have enough to go on
+const minDetectRunes = 20
+
+// DetectLangs guesses the language of redacted post text. it's empty unless
+// the guess is reliable.
+func DetectLangs(text string) []string {
+	// the redaction placeholders aren't in any language
+	text = strings.ReplaceAll(text, mentionReplacement, "")
+	text = strings.ReplaceAll(text, linkReplacement, "")
+	if utf8.RuneCountInString(strings.TrimSpace(text)) < minDetectRunes {
+		langDetectionCounter.WithLabelValues("too_short").Inc()
+		return []string{}
+	}
+	info := whatlanggo.Detect(text)
+	if !info.IsReliable() {
+		langDetectionCounter.WithLabelValues("unreliable").Inc()
+		return []string{}
+	}
+	code := info.Lang.Iso6391()
+	if code == "" {
+		code = info.Lang.Iso6393()
+	}
+	lang, err := CanonicalLang(code)
+	if err != nil {
+		langDetectionCounter.WithLabelValues("unreliable").Inc()
+		return []string{}
+	}
+	langDetectionCounter.WithLabelValues("detected").Inc()
+	return []string{lang}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectLangs(t *testing.T) {
+	for text, langs := range map[string][]string{
+		"the quick brown fox jumps over the lazy dog, and then it went home to sleep": {"en"},
+		"hoje eu acordei cedo e fui para a praia com os meus amigos, foi muito bom":   {"pt"},
+		"今日はとても良い天気なので、友達と一緒に公園へ散歩に行きました":                                             {"ja"},
+		"lol": {},
+		"@█████████ @█████████ www.█████████ ok": {},
+		"1234567890 1234567890 1234567890": {},
+	} {
+		if got := DetectLangs(text); !reflect.DeepEqual(got, langs) {
+			t.Errorf("%#v: expected %#v, got %#v", text, langs, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// /embed is a bare feed for iframes on other sites. it takes the same filter
+// params as the websocket url (see FilterFromQuery), plus:
+//
+//	?theme=dark&max=5
+//
+// which sites may frame it is up to each deployment: see FrameAncestors.
+
+const (
+	defaultEmbedPosts = 10
+	maxEmbedPosts     = 50
+)
+
+var embedThemes = map[string]bool{
+	"auto":  true, // follows prefers-color-scheme
+	"light": true,
+	"dark":  true,
+}
+
+type EmbedOptions struct {
+	Filter ObserverFilter
+	Theme  string
+	// posts stay until this many newer ones push them out
+	MaxPosts int
+}
+
+func EmbedOptionsFromQuery(query url.Values) (EmbedOptions, error) {
+	filter, err := FilterFromQuery(query)
+	if err != nil {
+		return EmbedOptions{}, err
+	}
+	o := EmbedOptions{
+		Filter:   filter,
+		Theme:    "auto",
+		MaxPosts: defaultEmbedPosts,
+	}
+	if theme := query.Get("theme"); theme != "" {
+		if !embedThemes[theme] {
+			return EmbedOptions{}, fmt.Errorf("unknown theme %#v", theme)
+		}
+		o.Theme = theme
+	}
+	if max := query.Get("max"); max != "" {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 1 || n > maxEmbedPosts {
+			return EmbedOptions{}, fmt.Errorf("bad max %#v (1 to %d)", max, maxEmbedPosts)
+		}
+		o.MaxPosts = n
+	}
+	return o, nil
+}
+
+// WsQuery is the filter for the embed's websocket url
+func (o EmbedOptions) WsQuery() string {
+	return o.Filter.Query().Encode()
+}
+
+type EmbedTemplateData struct {
+	IndexTemplateData
+	Embed EmbedOptions
+}
+
+// FrameAncestors are the CSP sources allowed to frame /embed. unset, it's
+// only our own pages.
+type FrameAncestors []string
+
+// ParseFrameAncestors reads space- or comma-separated CSP sources, like
+//
+//	https://example.com https://*.example.org
+//
+// or "*" for anywhere, or "'none'" to disable framing
+func ParseFrameAncestors(value string) (FrameAncestors, error) {
+	sources := FrameAncestors{}
+	for _, source := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		if strings.ContainsAny(source, ";'\"") && source != "'self'" && source != "'none'" {
+			return nil, fmt.Errorf("bad frame ancestor %#v", source)
+		}
+		sources = append(sources, source)
+	}
+	for _, source := range sources {
+		if source == "'none'" && len(sources) > 1 {
+			return nil, fmt.Errorf("'none' can't be combined with other frame ancestors")
+		}
+	}
+	return sources, nil
+}
+
+// Policy is the embed page's Content-Security-Policy (see contentPolicy)
+func (fa FrameAncestors) Policy(nonce string) string {
+	ancestors := "'self'"
+	if len(fa) > 0 {
+		ancestors = strings.Join(fa, " ")
+	}
+	return contentPolicy(nonce, ancestors)
+}
+
+func (s *Server) embed(w http.ResponseWriter, r *http.Request) {
+	options, err := EmbedOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.Header().Add("Cache-Control", "no-store") // the nonce
+	w.Header().Add("Vary", "accept-language")
+	w.Header().Set("Content-Security-Policy", s.frameAncestors.Policy(RequestNonce(r)))
+
+	t.ExecuteTemplate(w, "embed.html", EmbedTemplateData{
+		IndexTemplateData: s.templateData(r),
+		Embed:             options,
+	})
+}
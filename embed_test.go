@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmbedOptionsFromQuery(t *testing.T) {
+	o, err := EmbedOptionsFromQuery(url.Values{})
+	if err != nil || o.Theme != "auto" || o.MaxPosts != defaultEmbedPosts {
+		t.Fatalf("expected defaults, got %#v %#v", o, err)
+	}
+
+	o, err = EmbedOptionsFromQuery(url.Values{
+		"lang":   {"pt", "null"},
+		"target": {"reply"},
+		"theme":  {"light"},
+		"max":    {"3"},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse: %#v", err)
+	}
+	if o.Theme != "light" || o.MaxPosts != 3 || !reflect.DeepEqual(o.Filter.Targets, []string{"reply"}) {
+		t.Fatalf("unexpected options %#v", o)
+	}
+	if o.WsQuery() != "lang=pt&lang=null&target=reply" {
+		t.Fatalf("expected the filter for the websocket, got %#v", o.WsQuery())
+	}
+
+	for _, query := range []url.Values{
+		{"theme": {"neon"}},
+		{"max": {"0"}},
+		{"max": {"1000"}},
+		{"max": {"lots"}},
+		{"target": {"repost"}},
+		{"lang": {"english!"}},
+	} {
+		if _, err := EmbedOptionsFromQuery(query); err == nil {
+			t.Errorf("expected %#v to fail", query)
+		}
+	}
+}
+
+func TestParseFrameAncestors(t *testing.T) {
+	fa, err := ParseFrameAncestors("")
+	if err != nil || !strings.Contains(fa.Policy("n0nce"), "frame-ancestors 'self'") {
+		t.Fatalf("expected only our pages by default, got %#v %#v", fa.Policy("n0nce"), err)
+	}
+	fa, err = ParseFrameAncestors("https://example.com, https://*.example.org")
+	if err != nil || !strings.HasSuffix(fa.Policy("n0nce"), "; frame-ancestors https://example.com https://*.example.org") {
+		t.Fatalf("unexpected policy %#v %#v", fa.Policy("n0nce"), err)
+	}
+	for _, bad := range []string{
+		"https://example.com; script-src *",
+		"'unsafe-inline'",
+		"'none' https://example.com",
+	} {
+		if _, err := ParseFrameAncestors(bad); err == nil {
+			t.Errorf("expected %#v to fail", bad)
+		}
+	}
+}
+
+func TestEmbedPage(t *testing.T) {
+	server := newServer(NewObserverLimits(nil, nil, 0, 0, 0), FrameAncestors{"https://example.com"}, NewErrorReports())
+
+	w := httptest.NewRecorder()
+	server.embed(w, httptest.NewRequest("GET", "/embed?lang=ja&theme=dark&max=5", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-ancestors https://example.com") {
+		t.Fatalf("expected the deployment's frame ancestors, got %#v", csp)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		`data-theme="dark"`,
+		`const WS_QUERY = "lang=ja";`,
+		`const MAX_POSTS =  5 ;`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %#v in the page", expected)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	server.embed(w, httptest.NewRequest("GET", "/embed?max=-1", nil))
+	if w.Code != 400 {
+		t.Fatalf("expected bad options to be refused, got %d", w.Code)
+	}
+}
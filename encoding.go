@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"sync"
+)
+
+// Encoding is how messages are framed for one observer, picked with
+// `encoding` in the websocket url. messages have the same fields and shapes
+// in every encoding: cbor uses the json field names.
+type Encoding struct {
+	Name      string
+	FrameType int // websocket.TextMessage or websocket.BinaryMessage
+	Marshal   func(any) ([]byte, error)
+	Unmarshal func([]byte, any) error
+	// index into each broadcastMessage's prepared frames
+	id int
+}
+
+var JsonEncoding = &Encoding{
+	Name:      "json",
+	FrameType: websocket.TextMessage,
+	Marshal:   json.Marshal,
+	Unmarshal: json.Unmarshal,
+	id:        0,
+}
+
+var CborEncoding = &Encoding{
+	Name:      "cbor",
+	FrameType: websocket.BinaryMessage,
+	Marshal:   cbor.Marshal,
+	Unmarshal: cbor.Unmarshal,
+	id:        1,
+}
+
+var encodings = []*Encoding{JsonEncoding, CborEncoding}
+
+func GetEncoding(name string) (*Encoding, error) {
+	if name == "" {
+		return JsonEncoding, nil
+	}
+	for _, enc := range encodings {
+		if enc.Name == name {
+			return enc, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported encoding %#v", name)
+}
+
+// decoderFor picks how to read a client message: clients may send either
+// text (json) or binary (cbor) frames, whatever they receive
+func decoderFor(messageType int) func([]byte, any) error {
+	if messageType == websocket.BinaryMessage {
+		return CborEncoding.Unmarshal
+	}
+	return JsonEncoding.Unmarshal
+}
+
+func writeValue(c *websocket.Conn, enc *Encoding, v any) error {
+	data, err := enc.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(enc.FrameType, data)
+}
+
+// preparedFrame is a message framed for one encoding, made on first use
+// since most observers share one encoding
+type preparedFrame struct {
+	once     sync.Once
+	prepared *websocket.PreparedMessage
+}
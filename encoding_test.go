@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCborConnection(t *testing.T) {
+	server, wsUrl := testServer(t)
+	dialer := websocket.Dialer{EnableCompression: true}
+	c, res, err := dialer.Dial(wsUrl+"/?v=1&encoding=cbor", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	defer c.Close()
+	if !strings.Contains(res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Fatalf("expected compression to be negotiated, got %#v", res.Header.Get("Sec-Websocket-Extensions"))
+	}
+
+	read := func(v any) {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read: %#v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("expected a binary frame, got %q", data)
+		}
+		if err := cbor.Unmarshal(data, v); err != nil {
+			t.Fatalf("failed to decode cbor: %#v", err)
+		}
+	}
+
+	var hello HelloMessage
+	read(&hello)
+	if hello.Type != "hello" || hello.Version != ProtocolVersion {
+		t.Fatalf("unexpected hello %#v", hello)
+	}
+
+	setFilter, _ := cbor.Marshal(map[string]any{
+		"type":   "setFilter",
+		"id":     "c",
+		"filter": map[string]any{"keywords": []string{"cat"}},
+	})
+	c.WriteMessage(websocket.BinaryMessage, setFilter)
+	for {
+		var message struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+		}
+		read(&message)
+		if message.Type == "observers" {
+			continue
+		}
+		if message.Type != "ack" || message.ID != "c" {
+			t.Fatalf("expected an ack, got %#v", message)
+		}
+		break
+	}
+
+	for _, text := range []string{"a dog", "a cat"} {
+		server.send(ObserverMessage{
+			Type: ObserverMessageTypePost,
+			Post: &LikedPersistedPost{Post: &PersistedPost{TimeUS: time.Now().UnixMicro(), Text: text}},
+		})
+	}
+	for {
+		var message PostMessage
+		read(&message)
+		if message.Type != "post" {
+			continue
+		}
+		if message.Post.Value.Text != "a cat" || len(message.Post.Highlights) != 1 || message.Post.Highlights[0] != (Highlight{2, 5}) {
+			t.Fatalf("expected the filtered post with highlights, got %#v", message)
+		}
+		break
+	}
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	_, wsUrl := testServer(t)
+	c, _, err := websocket.DefaultDialer.Dial(wsUrl+"/?encoding=xml", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	defer c.Close()
+	var message ErrorMessage
+	if err := c.ReadJSON(&message); err != nil || message.Code != ErrorUnsupportedEncoding {
+		t.Fatalf("expected an unsupported encoding error, got %#v %#v", message, err)
+	}
+}
+
+func TestPreparedFramesPerEncoding(t *testing.T) {
+	bm := newBroadcastMessage(ObserverMessage{Type: ObserverMessageTypeObservers, ObserversCount: 2}, time.Now())
+	if bm.prepared(JsonEncoding) == nil || bm.prepared(CborEncoding) == nil {
+		t.Fatalf("expected a frame for each encoding")
+	}
+	if bm.prepared(JsonEncoding) != bm.prepared(JsonEncoding) {
+		t.Fatalf("frames should be prepared once")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// text filters run in the broadcaster's shards, for every post against every
+// observer that wants its language, before anything is queued. one slow
+// pattern holds up the whole shard, so they're kept small. go's regexps are
+// already linear-time; these bound the constant.
+const (
+	maxFilterKeywords  = 16
+	maxKeywordLength   = 64 // characters
+	maxPatternLength   = 256
+	maxPatternProgSize = 2_000 // compiled instructions
+)
+
+// ObserverFilter picks which deleted posts an observer sees. zero values
+// don't filter anything, so the empty filter shows everything.
+//
+// clients set it with a `setFilter` message, and it round-trips through the
+// websocket url's query string (see Query) so reconnects keep it.
+type ObserverFilter struct {
+	// BCP-47 tags: a base language like "pt" includes all of its regions and
+	// scripts. nil means posts with no language set
+	Langs []*string `json:"langs"`
+	// also pick posts without a declared language by their detected one
+	Detected bool `json:"detected"`
+	// "post", "reply", and/or "quote"
+	Targets []string `json:"targets"`
+	// age at deletion, in ms. MaxAgeMs 0 = no max
+	MinAgeMs int64 `json:"minAgeMs"`
+	MaxAgeMs int64 `json:"maxAgeMs"`
+	// posts with unknown like counts never pass a min
+	MinLikes uint32 `json:"minLikes"`
+	// in characters (code points), after redaction
+	TextLongerThan int `json:"textLongerThan"`
+	// nil = include bulk deletions
+	Bulk *bool `json:"bulk"`
+	// when either is set, the text has to contain one of the keywords or
+	// match the pattern. both ignore case and unicode normalization form.
+	Keywords []string `json:"keywords"`
+	Pattern  string   `json:"pattern"`
+}
+
+// Highlight is a matched span of a post's text, as [start, end) offsets in
+// UTF-16 code units so that javascript can slice the text with them
+type Highlight [2]int
+
+var filterTargets = map[string]bool{
+	"post":              true,
+	string(ReplyTarget): true,
+	string(QuoteTarget): true,
+}
+
+func (f ObserverFilter) Validate() error {
+	for _, lang := range f.Langs {
+		if lang != nil {
+			if _, err := CanonicalLang(*lang); err != nil {
+				return fmt.Errorf("bad language %#v", *lang)
+			}
+		}
+	}
+	for _, target := range f.Targets {
+		if !filterTargets[target] {
+			return fmt.Errorf("unknown target %#v", target)
+		}
+	}
+	if f.MinAgeMs < 0 || f.MaxAgeMs < 0 {
+		return fmt.Errorf("ages can't be negative")
+	}
+	if f.MaxAgeMs > 0 && f.MaxAgeMs < f.MinAgeMs {
+		return fmt.Errorf("max age %d is less than min age %d", f.MaxAgeMs, f.MinAgeMs)
+	}
+	if f.TextLongerThan < 0 {
+		return fmt.Errorf("text length can't be negative")
+	}
+	_, err := f.Matcher()
+	return err
+}
+
+// textPattern compiles the keywords and pattern into one case-insensitive
+// regexp over NFC text, or nil if there are neither
+func (f ObserverFilter) textPattern() (*regexp.Regexp, error) {
+	if len(f.Keywords) > maxFilterKeywords {
+		return nil, fmt.Errorf("too many keywords (max %d)", maxFilterKeywords)
+	}
+	alternatives := []string{}
+	for _, keyword := range f.Keywords {
+		keyword = norm.NFC.String(strings.TrimSpace(keyword))
+		if keyword == "" {
+			return nil, fmt.Errorf("empty keyword")
+		}
+		if utf8.RuneCountInString(keyword) > maxKeywordLength {
+			return nil, fmt.Errorf("keyword too long (max %d characters)", maxKeywordLength)
+		}
+		alternatives = append(alternatives, regexp.QuoteMeta(keyword))
+	}
+	if f.Pattern != "" {
+		if len(f.Pattern) > maxPatternLength {
+			return nil, fmt.Errorf("pattern too long (max %d bytes)", maxPatternLength)
+		}
+		parsed, err := syntax.Parse(norm.NFC.String(f.Pattern), syntax.Perl)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern: %w", err)
+		}
+		alternatives = append(alternatives, "(?:"+parsed.String()+")")
+	}
+	if len(alternatives) == 0 {
+		return nil, nil
+	}
+
+	expr := "(?i)" + strings.Join(alternatives, "|")
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern: %w", err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern: %w", err)
+	}
+	if len(prog.Inst) > maxPatternProgSize {
+		return nil, fmt.Errorf("pattern too complex")
+	}
+	return regexp.Compile(expr)
+}
+
+// FilterFromQuery reads a filter from websocket url params:
+//
+//	?lang=en&lang=null&detected=true&target=reply&minAge=1000&maxAge=60000&minLikes=1&textLongerThan=20&bulk=false&keyword=cat&pattern=dogs?
+func FilterFromQuery(query url.Values) (ObserverFilter, error) {
+	f := ObserverFilter{}
+	for _, lang := range query["lang"] {
+		if lang == "null" {
+			f.Langs = append(f.Langs, nil)
+		} else {
+			f.Langs = append(f.Langs, &lang)
+		}
+	}
+	f.Targets = query["target"]
+	f.Keywords = query["keyword"]
+	f.Pattern = query.Get("pattern")
+
+	var err error
+	parseInt := func(name string, bits int) int64 {
+		value := query.Get(name)
+		if value == "" || err != nil {
+			return 0
+		}
+		n, parseErr := strconv.ParseInt(value, 10, bits)
+		if parseErr != nil {
+			err = fmt.Errorf("bad %s %#v", name, value)
+		}
+		return n
+	}
+	f.MinAgeMs = parseInt("minAge", 64)
+	f.MaxAgeMs = parseInt("maxAge", 64)
+	minLikes := parseInt("minLikes", 64)
+	f.TextLongerThan = int(parseInt("textLongerThan", 32))
+	if err != nil {
+		return ObserverFilter{}, err
+	}
+	if minLikes < 0 || minLikes > int64(^uint32(0)) {
+		return ObserverFilter{}, fmt.Errorf("bad minLikes %d", minLikes)
+	}
+	f.MinLikes = uint32(minLikes)
+
+	if detected := query.Get("detected"); detected != "" {
+		wantsDetected, parseErr := strconv.ParseBool(detected)
+		if parseErr != nil {
+			return ObserverFilter{}, fmt.Errorf("bad detected %#v", detected)
+		}
+		f.Detected = wantsDetected
+	}
+
+	if bulk := query.Get("bulk"); bulk != "" {
+		wantsBulk, parseErr := strconv.ParseBool(bulk)
+		if parseErr != nil {
+			return ObserverFilter{}, fmt.Errorf("bad bulk %#v", bulk)
+		}
+		f.Bulk = &wantsBulk
+	}
+
+	return f, f.Validate()
+}
+
+// Query is the inverse of FilterFromQuery
+func (f ObserverFilter) Query() url.Values {
+	query := url.Values{}
+	for _, lang := range f.Langs {
+		if lang == nil {
+			query.Add("lang", "null")
+		} else {
+			query.Add("lang", *lang)
+		}
+	}
+	if f.Detected {
+		query.Set("detected", "true")
+	}
+	for _, target := range f.Targets {
+		query.Add("target", target)
+	}
+	if f.MinAgeMs > 0 {
+		query.Set("minAge", strconv.FormatInt(f.MinAgeMs, 10))
+	}
+	if f.MaxAgeMs > 0 {
+		query.Set("maxAge", strconv.FormatInt(f.MaxAgeMs, 10))
+	}
+	if f.MinLikes > 0 {
+		query.Set("minLikes", strconv.FormatUint(uint64(f.MinLikes), 10))
+	}
+	if f.TextLongerThan > 0 {
+		query.Set("textLongerThan", strconv.Itoa(f.TextLongerThan))
+	}
+	if f.Bulk != nil {
+		query.Set("bulk", strconv.FormatBool(*f.Bulk))
+	}
+	for _, keyword := range f.Keywords {
+		query.Add("keyword", keyword)
+	}
+	if f.Pattern != "" {
+		query.Set("pattern", f.Pattern)
+	}
+	return query
+}
+
+// filterMatcher is a filter prepared for checking every post
+type filterMatcher struct {
+	filter            ObserverFilter
+	langs             map[string]bool
+	wantsUnknownLangs bool
+	targets           map[string]bool
+	text              *regexp.Regexp
+}
+
+func (f ObserverFilter) Matcher() (*filterMatcher, error) {
+	text, err := f.textPattern()
+	if err != nil {
+		return nil, err
+	}
+	m := &filterMatcher{
+		filter:  f,
+		langs:   map[string]bool{},
+		targets: map[string]bool{},
+		text:    text,
+	}
+	for _, lang := range f.Langs {
+		if lang == nil {
+			m.wantsUnknownLangs = true
+		} else if canonical, err := CanonicalLang(*lang); err == nil {
+			m.langs[canonical] = true
+		}
+	}
+	for _, target := range f.Targets {
+		m.targets[target] = true
+	}
+	return m, nil
+}
+
+// Matches checks a post against the filter. with text filters, it also
+// returns the matched spans of the post's NFC text.
+func (m *filterMatcher) Matches(liked *LikedPersistedPost, t time.Time) (bool, []Highlight) {
+	if !m.listening(liked.Post) {
+		return false, nil
+	}
+	return m.matchesRouted(liked, t)
+}
+
+// listening checks the post's languages, like ListeningFor, but also with its
+// detected languages if the filter wants them
+func (m *filterMatcher) listening(post *PersistedPost) bool {
+	if ListeningFor(m.langs, m.wantsUnknownLangs, post.Langs) {
+		return true
+	}
+	return m.filter.Detected && len(m.langs) > 0 && len(post.Langs) == 0 &&
+		ListeningFor(m.langs, false, post.DetectedLangs)
+}
+
+// matchesRouted is Matches for posts the broadcaster already routed by
+// language (see langIndex)
+func (m *filterMatcher) matchesRouted(liked *LikedPersistedPost, t time.Time) (bool, []Highlight) {
+	if !m.matchesMeta(liked, t) {
+		return false, nil
+	}
+	if m.text == nil {
+		return true, nil
+	}
+	text := norm.NFC.String(liked.Post.Text)
+	highlights := utf16Highlights(text, m.text.FindAllStringIndex(text, -1))
+	// patterns like `a*` match nothing everywhere, which doesn't count
+	return len(highlights) > 0, highlights
+}
+
+// utf16Highlights converts the non-empty byte spans of text into UTF-16
+// offsets. spans must be in order and not overlap, like regexp returns them.
+func utf16Highlights(text string, spans [][]int) []Highlight {
+	highlights := []Highlight{}
+	units, at := 0, 0
+	advance := func(to int) int {
+		for _, r := range text[at:to] {
+			units += utf16Len(r)
+		}
+		at = to
+		return units
+	}
+	for _, span := range spans {
+		if span[0] == span[1] {
+			continue
+		}
+		start := advance(span[0])
+		end := advance(span[1])
+		highlights = append(highlights, Highlight{start, end})
+	}
+	return highlights
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+func (m *filterMatcher) matchesMeta(liked *LikedPersistedPost, t time.Time) bool {
+	post := liked.Post
+	if len(m.targets) > 0 && !m.targets[post.TargetName()] {
+		return false
+	}
+	if age := post.AgeMs(t); age < m.filter.MinAgeMs ||
+		(m.filter.MaxAgeMs > 0 && age > m.filter.MaxAgeMs) {
+		return false
+	}
+	if m.filter.MinLikes > 0 && (liked.Likes == nil || *liked.Likes < m.filter.MinLikes) {
+		return false
+	}
+	if m.filter.TextLongerThan > 0 && utf8.RuneCountInString(post.Text) <= m.filter.TextLongerThan {
+		return false
+	}
+	if m.filter.Bulk != nil && !*m.filter.Bulk && liked.Kind == BulkDeletion {
+		return false
+	}
+	return true
+}
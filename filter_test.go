@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterQueryRoundTrip(t *testing.T) {
+	en := "en"
+	no := false
+	filters := []ObserverFilter{
+		{},
+		{Langs: []*string{&en, nil}},
+		{Langs: []*string{&en}, Detected: true},
+		{
+			Langs:          []*string{&en},
+			Targets:        []string{"post", "quote"},
+			MinAgeMs:       1000,
+			MaxAgeMs:       60_000,
+			MinLikes:       3,
+			TextLongerThan: 20,
+			Bulk:           &no,
+		},
+	}
+	for _, filter := range filters {
+		query := filter.Query()
+		parsed, err := FilterFromQuery(query)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %#v", query.Encode(), err)
+		}
+		if !reflect.DeepEqual(parsed.Query(), query) {
+			t.Fatalf("round trip changed %s to %s", query.Encode(), parsed.Query().Encode())
+		}
+	}
+}
+
+func TestFilterFromQueryRejects(t *testing.T) {
+	for _, raw := range []string{
+		"target=repost",
+		"minAge=-1",
+		"minAge=10&maxAge=5",
+		"minLikes=lots",
+		"minLikes=-2",
+		"textLongerThan=-1",
+		"bulk=maybe",
+		"lang=english!",
+		"lang=und",
+		"detected=sure",
+	} {
+		query, _ := url.ParseQuery(raw)
+		if _, err := FilterFromQuery(query); err == nil {
+			t.Fatalf("expected %#v to be rejected", raw)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	now := time.Now()
+	reply := ReplyTarget
+	two := uint32(2)
+	yes, no := true, false
+	en := "en"
+	post := func(text string, langs []string, target *PostTargetType, ageMs int64, likes *uint32, kind DeletionKind) *LikedPersistedPost {
+		return &LikedPersistedPost{
+			Post: &PersistedPost{
+				TimeUS: now.Add(-time.Duration(ageMs) * time.Millisecond).UnixMicro(),
+				Text:   text,
+				Langs:  langs,
+				Target: target,
+			},
+			Likes: likes,
+			Kind:  kind,
+		}
+	}
+	plain := post("hello there", []string{"en"}, nil, 5_000, nil, OrganicDeletion)
+
+	for i, c := range []struct {
+		filter ObserverFilter
+		post   *LikedPersistedPost
+		expect bool
+	}{
+		{ObserverFilter{}, plain, true},
+		{ObserverFilter{Langs: []*string{&en}}, plain, true},
+		{ObserverFilter{Langs: []*string{nil}}, plain, false},
+		{ObserverFilter{Targets: []string{"post"}}, plain, true},
+		{ObserverFilter{Targets: []string{"reply"}}, plain, false},
+		{ObserverFilter{Targets: []string{"reply"}}, post("hi", nil, &reply, 5_000, nil, OrganicDeletion), true},
+		{ObserverFilter{MinAgeMs: 1_000}, plain, true},
+		{ObserverFilter{MinAgeMs: 10_000}, plain, false},
+		{ObserverFilter{MaxAgeMs: 10_000}, plain, true},
+		{ObserverFilter{MaxAgeMs: 1_000}, plain, false},
+		{ObserverFilter{MinLikes: 1}, plain, false}, // unknown likes
+		{ObserverFilter{MinLikes: 2}, post("hi", nil, nil, 0, &two, OrganicDeletion), true},
+		{ObserverFilter{MinLikes: 3}, post("hi", nil, nil, 0, &two, OrganicDeletion), false},
+		{ObserverFilter{TextLongerThan: 10}, plain, true},
+		{ObserverFilter{TextLongerThan: 11}, plain, false},
+		{ObserverFilter{TextLongerThan: 2}, post("日本語", nil, nil, 0, nil, OrganicDeletion), true},
+		{ObserverFilter{Bulk: &no}, post("hi", nil, nil, 0, nil, BulkDeletion), false},
+		{ObserverFilter{Bulk: &yes}, post("hi", nil, nil, 0, nil, BulkDeletion), true},
+		{ObserverFilter{}, post("hi", nil, nil, 0, nil, BulkDeletion), true},
+	} {
+		matcher, err := c.filter.Matcher()
+		if err != nil {
+			t.Fatalf("case %d: bad filter: %#v", i, err)
+		}
+		if got, _ := matcher.Matches(c.post, now); got != c.expect {
+			t.Fatalf("case %d: expected %v, got %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestFilterText(t *testing.T) {
+	now := time.Now()
+	post := func(text string) *LikedPersistedPost {
+		return &LikedPersistedPost{Post: &PersistedPost{TimeUS: now.UnixMicro(), Text: text}}
+	}
+	for i, c := range []struct {
+		filter     ObserverFilter
+		text       string
+		expect     bool
+		highlights []Highlight
+	}{
+		{ObserverFilter{Keywords: []string{"cat"}}, "a Cat and a CAT", true, []Highlight{{2, 5}, {12, 15}}},
+		{ObserverFilter{Keywords: []string{"cat"}}, "a dog", false, nil},
+		{ObserverFilter{Keywords: []string{"cat", "dog"}}, "a dog", true, []Highlight{{2, 5}}},
+		{ObserverFilter{Keywords: []string{"a.c"}}, "abc", false, nil}, // keywords are literal
+		// NFD text matches an NFC keyword, and highlights index the NFC text
+		{ObserverFilter{Keywords: []string{"café"}}, "le cafe\u0301", true, []Highlight{{3, 7}}},
+		{ObserverFilter{Keywords: []string{"ΣΟΦΊΑ"}}, "σοφία", true, []Highlight{{0, 5}}},
+		// offsets are in UTF-16 code units
+		{ObserverFilter{Keywords: []string{"cat"}}, "🐈 cat", true, []Highlight{{3, 6}}},
+		{ObserverFilter{Pattern: `dogs?\b`}, "Dogs and dog", true, []Highlight{{0, 4}, {9, 12}}},
+		{ObserverFilter{Pattern: `x*`}, "nothing here", false, nil},
+		{ObserverFilter{Keywords: []string{"cat"}, Pattern: `dog`}, "dog", true, []Highlight{{0, 3}}},
+	} {
+		matcher, err := c.filter.Matcher()
+		if err != nil {
+			t.Fatalf("case %d: bad filter: %#v", i, err)
+		}
+		got, highlights := matcher.Matches(post(c.text), now)
+		if got != c.expect {
+			t.Fatalf("case %d: expected %v, got %v", i, c.expect, got)
+		}
+		if c.expect && !reflect.DeepEqual(highlights, c.highlights) {
+			t.Fatalf("case %d: expected highlights %v, got %v", i, c.highlights, highlights)
+		}
+	}
+}
+
+func TestFilterTextLimits(t *testing.T) {
+	tooMany := make([]string, maxFilterKeywords+1)
+	for i := range tooMany {
+		tooMany[i] = "word"
+	}
+	for i, filter := range []ObserverFilter{
+		{Keywords: tooMany},
+		{Keywords: []string{"  "}},
+		{Keywords: []string{strings.Repeat("a", maxKeywordLength+1)}},
+		{Pattern: "("},
+		{Pattern: strings.Repeat("a", maxPatternLength+1)},
+		{Pattern: "(a{100}){100}"},
+		{Pattern: "(abc){1000}"},
+	} {
+		if err := filter.Validate(); err == nil {
+			t.Fatalf("case %d: expected filter to be rejected", i)
+		}
+	}
+}
@@ -3,11 +3,14 @@ module github.com/uniphil/bsky-deletions
 go 1.22
 
 require (
+	github.com/abadojack/whatlanggo v1.0.1
 	github.com/bluesky-social/indigo v0.0.0-20241008040750-06bacb465af7
 	github.com/bluesky-social/jetstream v0.0.0-20241031234625-0ab10bd041fe
 	github.com/cockroachdb/pebble v1.1.2
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/prometheus/client_golang v1.20.5
+	golang.org/x/text v0.16.0
 )
 
 require (
@@ -66,6 +69,7 @@ require (
 	github.com/rogpeppe/go-internal v1.12.0 // indirect
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	github.com/whyrusleeping/cbor-gen v0.1.3-0.20240904181319-8dc02b38228c // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.46.1 // indirect
 	go.opentelemetry.io/otel v1.21.0 // indirect
 	go.opentelemetry.io/otel/metric v1.21.0 // indirect
@@ -77,7 +81,6 @@ require (
 	golang.org/x/exp v0.0.0-20240604190554-fc45aab8b7f8 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sys v0.22.0 // indirect
-	golang.org/x/text v0.16.0 // indirect
 	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
 	google.golang.org/protobuf v1.34.2 // indirect
 	lukechampine.com/blake3 v1.2.1 // indirect
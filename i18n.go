@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/text/language"
+	"io/fs"
+	"strings"
+)
+
+// the page's UI text lives in messages.<lang>.json next to index.html, and is
+// picked by Accept-Language. english is the default, and fills in anything a
+// translation is missing.
+
+const defaultCatalogLang = "en"
+
+// Catalog is the UI text in one language, by message key. in templates:
+//
+//	{{ .T.title }}  {{ .T.Format "langStatsWindow" 60 }}
+type Catalog map[string]string
+
+// Format fills a message's {n} with n
+func (c Catalog) Format(key string, n any) string {
+	return strings.ReplaceAll(c[key], "{n}", fmt.Sprint(n))
+}
+
+// Catalogs are every language's Catalog, with a matcher to pick one
+type Catalogs struct {
+	langs    []string // default first
+	catalogs []Catalog
+	matcher  language.Matcher
+}
+
+func LoadCatalogs(fsys fs.FS) (*Catalogs, error) {
+	paths, err := fs.Glob(fsys, "messages.*.json")
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]Catalog{}
+	for _, path := range paths {
+		lang := strings.TrimSuffix(strings.TrimPrefix(path, "messages."), ".json")
+		canonical, err := CanonicalLang(lang)
+		if err != nil {
+			return nil, fmt.Errorf("bad catalog language in %#v: %w", path, err)
+		}
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+		catalog := Catalog{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("bad catalog %#v: %w", path, err)
+		}
+		loaded[canonical] = catalog
+	}
+	fallback, ok := loaded[defaultCatalogLang]
+	if !ok {
+		return nil, fmt.Errorf("missing the default catalog messages.%s.json", defaultCatalogLang)
+	}
+
+	c := &Catalogs{}
+	add := func(lang string, catalog Catalog) {
+		for key, message := range fallback {
+			if _, ok := catalog[key]; !ok {
+				catalog[key] = message
+			}
+		}
+		c.langs = append(c.langs, lang)
+		c.catalogs = append(c.catalogs, catalog)
+	}
+	add(defaultCatalogLang, fallback)
+	for lang, catalog := range loaded {
+		if lang != defaultCatalogLang {
+			add(lang, catalog)
+		}
+	}
+	tags := []language.Tag{}
+	for _, lang := range c.langs {
+		tags = append(tags, language.MustParse(lang))
+	}
+	c.matcher = language.NewMatcher(tags)
+	return c, nil
+}
+
+// Negotiate picks the catalog for an Accept-Language header, and its language
+func (c *Catalogs) Negotiate(acceptLanguage string) (string, Catalog) {
+	_, i, _ := c.matcher.Match(acceptLanguageTags(acceptLanguage)...)
+	return c.langs[i], c.catalogs[i]
+}
+
+var catalogs = mustLoadCatalogs()
+
+func mustLoadCatalogs() *Catalogs {
+	c, err := LoadCatalogs(resources)
+	if err != nil {
+		panic(fmt.Sprintf("failed to load message catalogs: %s", err))
+	}
+	return c
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCatalogsComplete(t *testing.T) {
+	paths, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatalf("failed to list: %#v", err)
+	}
+	en := catalogs.catalogs[0]
+	for _, entry := range paths {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "messages.") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		// load each alone, so english doesn't fill in what's missing
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %s: %#v", name, err)
+		}
+		alone, err := LoadCatalogs(fstest.MapFS{
+			"messages.en.json": {Data: data},
+		})
+		if err != nil {
+			t.Fatalf("failed to load %s: %#v", name, err)
+		}
+		catalog := alone.catalogs[0]
+		for key := range en {
+			if catalog[key] == "" {
+				t.Errorf("%s is missing %#v", name, key)
+			}
+		}
+		for key := range catalog {
+			if _, ok := en[key]; !ok {
+				t.Errorf("%s has %#v, which english doesn't", name, key)
+			}
+		}
+	}
+}
+
+func TestCatalogsFallback(t *testing.T) {
+	c, err := LoadCatalogs(fstest.MapFS{
+		"messages.en.json": {Data: []byte(`{"title": "Final words", "about": "about"}`)},
+		"messages.pt.json": {Data: []byte(`{"title": "Últimas palavras"}`)},
+	})
+	if err != nil {
+		t.Fatalf("failed to load: %#v", err)
+	}
+	lang, catalog := c.Negotiate("pt-BR")
+	if lang != "pt" || catalog["title"] != "Últimas palavras" || catalog["about"] != "about" {
+		t.Fatalf("expected pt with english filling in, got %#v %#v", lang, catalog)
+	}
+
+	if _, err := LoadCatalogs(fstest.MapFS{
+		"messages.pt.json": {Data: []byte(`{}`)},
+	}); err == nil {
+		t.Fatalf("expected a missing english catalog to fail")
+	}
+	if _, err := LoadCatalogs(fstest.MapFS{
+		"messages.en.json":      {Data: []byte(`{}`)},
+		"messages.english.json": {Data: []byte(`{}`)},
+	}); err == nil {
+		t.Fatalf("expected a bad catalog language to fail")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                    "en",
+		"pt-BR,pt;q=0.9":      "pt",
+		"ja-JP":               "ja",
+		"de-CH, de;q=0.9":     "en",
+		"de, ja;q=0.5":        "ja",
+		"not a language!!":    "en",
+		"x!!, pt;q=0.5":       "pt",
+		"en-GB, pt;q=0.8, ja": "en",
+	} {
+		if lang, _ := catalogs.Negotiate(header); lang != expected {
+			t.Errorf("%#v: expected %#v, got %#v", header, expected, lang)
+		}
+	}
+}
+
+func TestIndexLocalized(t *testing.T) {
+	server := newServer(NewObserverLimits(nil, nil, 0, 0, 0), nil, NewErrorReports())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "pt-BR")
+	w := httptest.NewRecorder()
+	server.index(w, r)
+	body := w.Body.String()
+	if !strings.Contains(body, `<html lang="pt">`) || !strings.Contains(body, "<title>Últimas palavras</title>") {
+		t.Fatalf("expected the portuguese page, got %s", body)
+	}
+	if !strings.Contains(body, `"title":"Últimas palavras"`) {
+		t.Fatalf("expected the catalog for scripts")
+	}
+}
@@ -1,17 +1,51 @@
 package main
 
 import (
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"golang.org/x/text/language"
+	"log"
 	"sort"
-	"strings"
+	"strconv"
 	"time"
 )
 
+// languages are BCP-47 tags in canonical form, like "en", "pt-BR", or
+// "zh-Hant". listeners can pick a base language to hear all of its regions
+// and scripts, or a more specific tag for just that one (see ListenKeys).
+
+// CanonicalLang parses a language tag into its canonical form
+func CanonicalLang(lang string) (string, error) {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return "", err
+	}
+	if tag == language.Und {
+		return "", fmt.Errorf("undetermined language %#v", lang)
+	}
+	return tag.String(), nil
+}
+
+// BaseLang is the language without script or region: "pt" for "pt-BR"
+func BaseLang(lang string) string {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return lang
+	}
+	base, _ := tag.Base()
+	return base.String()
+}
+
+// NormalizeLangs canonicalizes a post's language tags, dropping malformed
+// and repeated ones
 func NormalizeLangs(langs []string) []string {
 	normalized := []string{}
 	seen := map[string]bool{}
 	for _, lang := range langs {
-		before, _, _ := strings.Cut(lang, "-")
-		k := strings.ToLower(before)
+		k, err := CanonicalLang(lang)
+		if err != nil {
+			continue
+		}
 		if !seen[k] {
 			normalized = append(normalized, k)
 			seen[k] = true
@@ -20,7 +54,52 @@ func NormalizeLangs(langs []string) []string {
 	return normalized
 }
 
-func topLangs(topLangCount int64, langsSeen map[string]int64) []string {
+// ListenKeys are the listener languages that hear a post's language: its
+// base language, and the base with each subtag that the post's tag sets. a
+// script implied by the region counts, so "zh-TW" is heard by "zh-Hant"
+// listeners, but a region is never implied.
+func ListenKeys(lang string) []string {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return []string{lang}
+	}
+	base, _ := tag.Base()
+	script, scriptConfidence := tag.Script()
+	region, regionConfidence := tag.Region()
+	hasScript := scriptConfidence == language.Exact ||
+		(regionConfidence == language.Exact && scriptConfidence > language.No)
+	parts := [][]any{{base}}
+	if hasScript {
+		parts = append(parts, []any{base, script})
+	}
+	if regionConfidence == language.Exact {
+		parts = append(parts, []any{base, region})
+		if hasScript {
+			parts = append(parts, []any{base, script, region})
+		}
+	}
+	keys := []string{}
+	seen := map[string]bool{}
+	add := func(key string) {
+		if !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+	for _, part := range parts {
+		if composed, err := language.Compose(part...); err == nil {
+			add(composed.String())
+		}
+	}
+	add(tag.String())
+	return keys
+}
+
+func topLangs(langsSeen map[string]float64) []string {
+	var topLangCount float64
+	for _, count := range langsSeen {
+		topLangCount = max(topLangCount, count)
+	}
 	langs := []string{}
 	for lang, count := range langsSeen {
 		if count > (topLangCount / 1000) {
@@ -33,27 +112,248 @@ func topLangs(topLangCount int64, langsSeen map[string]int64) []string {
 	return langs
 }
 
-func CountLangs(postLangs <-chan []string) <-chan []string {
-	topLangsFeed := make(chan []string)
+// LangEvent is a post created or deleted, by its languages
+type LangEvent struct {
+	Langs   []string
+	Deleted bool
+	// when jetstream saw it, so that catching up after a restart counts
+	// events when they happened. zero = now
+	At time.Time
+}
+
+var (
+	langStatsWindow time.Duration = MustParseDuration("1h")
+	langStatsBucket time.Duration = MustParseDuration("1m")
+)
+
+const (
+	// a language needs this many posts in the window before its deletion
+	// ratio means anything
+	unusualMinPosts = 200
+	// unusual: deleting at more than this times the overall ratio
+	unusualRatioFactor = 2.0
+	// languages listed in LangStats, busiest first
+	maxLangStats = 50
+	// counts posts without a language: never a normalized language
+	unknownLang = "-"
+)
+
+// LangStats is a snapshot of posts and deletions per base language over the
+// last window. deletions only count posts that were in the cache, so that their
+// languages are known.
+type LangStats struct {
+	WindowSeconds int        `json:"windowSeconds"`
+	Posts         int64      `json:"posts"`
+	Deletions     int64      `json:"deletions"`
+	Ratio         float64    `json:"ratio"`
+	Langs         []LangStat `json:"langs"`
+	// for the language filter (see topLangs)
+	Known []string `json:"-"`
+}
+
+type LangStat struct {
+	Lang      *string `json:"lang"` // null for posts without a language
+	Posts     int64   `json:"posts"`
+	Deletions int64   `json:"deletions"`
+	Ratio     float64 `json:"ratio"`
+	// deleted much more than the other languages
+	Unusual bool `json:"unusual"`
+}
+
+func (stats LangStats) WindowMinutes() int {
+	return stats.WindowSeconds / 60
+}
+
+// Percent is the deletion ratio for people
+func (stat LangStat) Percent() string {
+	return strconv.FormatFloat(stat.Ratio*100, 'f', 1, 64) + "%"
+}
+
+type langCounts struct {
+	posts     int64
+	deletions int64
+}
+
+func (c *langCounts) add(deleted bool) {
+	if deleted {
+		c.deletions += 1
+	} else {
+		c.posts += 1
+	}
+}
+
+func (c langCounts) ratio() float64 {
+	if c.posts == 0 {
+		return 0
+	}
+	return float64(c.deletions) / float64(c.posts)
+}
+
+type langBucket struct {
+	total langCounts // each post once, whatever its languages
+	langs map[string]langCounts
+}
+
+// langWindow counts posts and deletions over a sliding window, in a ring of
+// buckets that are forgotten as they fall out of it
+type langWindow struct {
+	buckets     []langBucket
+	bucketSize  time.Duration
+	current     int
+	currentFrom time.Time
+}
+
+func newLangWindow(window, bucketSize time.Duration, now time.Time) *langWindow {
+	buckets := make([]langBucket, max(1, int(window/bucketSize)))
+	for i := range buckets {
+		buckets[i].langs = map[string]langCounts{}
+	}
+	return &langWindow{
+		buckets:     buckets,
+		bucketSize:  bucketSize,
+		currentFrom: now.Truncate(bucketSize),
+	}
+}
+
+func (w *langWindow) advance(now time.Time) {
+	for i := 0; i < len(w.buckets) && now.Sub(w.currentFrom) >= w.bucketSize; i++ {
+		w.current = (w.current + 1) % len(w.buckets)
+		w.buckets[w.current] = langBucket{langs: map[string]langCounts{}}
+		w.currentFrom = w.currentFrom.Add(w.bucketSize)
+	}
+	if now.Sub(w.currentFrom) >= w.bucketSize { // idle for the whole window
+		w.currentFrom = now.Truncate(w.bucketSize)
+	}
+}
+
+func (w *langWindow) add(event LangEvent, now time.Time) {
+	w.advance(now)
+	ago := 0
+	if !event.At.IsZero() && event.At.Before(w.currentFrom) {
+		// rounding up: it's in the bucket that starts at or before it
+		ago = int((w.currentFrom.Sub(event.At) + w.bucketSize - 1) / w.bucketSize)
+	}
+	if ago >= len(w.buckets) {
+		return // already out of the window
+	}
+	bucket := &w.buckets[(w.current-ago+len(w.buckets))%len(w.buckets)]
+	bucket.total.add(event.Deleted)
+	langs := map[string]bool{}
+	for _, lang := range event.Langs {
+		langs[BaseLang(lang)] = true
+	}
+	if len(langs) == 0 {
+		langs[unknownLang] = true
+	}
+	for lang := range langs {
+		counts := bucket.langs[lang]
+		counts.add(event.Deleted)
+		bucket.langs[lang] = counts
+	}
+}
+
+func (w *langWindow) stats(now time.Time) LangStats {
+	w.advance(now)
+	total := langCounts{}
+	byLang := map[string]langCounts{}
+	for _, bucket := range w.buckets {
+		total.posts += bucket.total.posts
+		total.deletions += bucket.total.deletions
+		for lang, counts := range bucket.langs {
+			sum := byLang[lang]
+			sum.posts += counts.posts
+			sum.deletions += counts.deletions
+			byLang[lang] = sum
+		}
+	}
+
+	stats := LangStats{
+		WindowSeconds: int((time.Duration(len(w.buckets)) * w.bucketSize).Seconds()),
+		Posts:         total.posts,
+		Deletions:     total.deletions,
+		Ratio:         total.ratio(),
+		Langs:         []LangStat{},
+	}
+	for lang, counts := range byLang {
+		stat := LangStat{
+			Posts:     counts.posts,
+			Deletions: counts.deletions,
+			Ratio:     counts.ratio(),
+		}
+		if lang != unknownLang {
+			stat.Lang = &lang
+		}
+		stat.Unusual = counts.posts >= unusualMinPosts &&
+			stats.Ratio > 0 && stat.Ratio > unusualRatioFactor*stats.Ratio
+		stats.Langs = append(stats.Langs, stat)
+	}
+	sort.Slice(stats.Langs, func(i, j int) bool {
+		a, b := stats.Langs[i], stats.Langs[j]
+		if a.Posts != b.Posts {
+			return a.Posts > b.Posts
+		}
+		if a.Deletions != b.Deletions {
+			return a.Deletions > b.Deletions
+		}
+		return a.Lang != nil && (b.Lang == nil || *a.Lang < *b.Lang)
+	})
+	if len(stats.Langs) > maxLangStats {
+		stats.Langs = stats.Langs[:maxLangStats]
+	}
+	return stats
+}
+
+// CountLangs publishes LangStats, starting right away with the known
+// languages from popularity. with a db, popularity is saved to it regularly.
+func CountLangs(langEvents <-chan LangEvent, popularity *LangPopularity, db *pebble.DB) <-chan LangStats {
+	langStatsFeed := make(chan LangStats)
 
 	go func() {
-		var topLangCount int64
-		langsSeen := map[string]int64{}
+		window := newLangWindow(langStatsWindow, langStatsBucket, time.Now())
+		publish := func() {
+			stats := window.stats(time.Now())
+			stats.Known = popularity.Top(time.Now())
+			langStatsFeed <- stats
+		}
+		publish()
 		langsUpdateTicker := time.NewTicker(4 * time.Second)
+		langsSaveTicker := time.NewTicker(langsSaveInterval)
 		for {
 			select {
-			case langs := <-postLangs:
-				for _, lang := range langs {
-					langsSeen[lang] += 1
-					topLangCount = max(topLangCount, langsSeen[lang])
+			case event := <-langEvents:
+				window.add(event, time.Now())
+				if event.Deleted {
+					continue
+				}
+				// both, so that the language list can offer "pt" as well
+				// as a busy "pt-BR"
+				bases := map[string]bool{}
+				for _, lang := range event.Langs {
+					if base := BaseLang(lang); base != lang && !bases[base] {
+						bases[base] = true
+						popularity.Add(base)
+					}
+				}
+				for _, lang := range event.Langs {
+					if !bases[lang] {
+						popularity.Add(lang)
+					}
 				}
 			case <-langsUpdateTicker.C:
-				topLangsFeed <- topLangs(topLangCount, langsSeen)
+				publish()
+			case <-langsSaveTicker.C:
+				if db == nil {
+					continue
+				}
+				popularity.Decay(time.Now())
+				if err := popularity.Save(db); err != nil {
+					log.Println("failed to save language popularity", err)
+				}
 			}
 		}
 	}()
 
-	return topLangsFeed
+	return langStatsFeed
 }
 
 func ListeningFor(listenerLangs map[string]bool, wantsUnknown bool, postLangs []string) bool {
@@ -68,8 +368,10 @@ func ListeningFor(listenerLangs map[string]bool, wantsUnknown bool, postLangs []
 		return wantsUnknown // no unknown langs unless asked for
 	}
 	for _, postLang := range postLangs {
-		if listenerLangs[postLang] {
-			return true
+		for _, key := range ListenKeys(postLang) {
+			if listenerLangs[key] {
+				return true
+			}
 		}
 	}
 	return false
@@ -3,6 +3,7 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNormalizeLangs(t *testing.T) {
@@ -18,25 +19,73 @@ func TestNormalizeLangs(t *testing.T) {
 	if !reflect.DeepEqual(NormalizeLangs([]string{"pt", "en"}), []string{"pt", "en"}) {
 		t.Fatalf("distinct elements should remain")
 	}
-	if !reflect.DeepEqual(NormalizeLangs([]string{"en-CA", "en"}), []string{"en"}) {
-		t.Fatalf("hyphenated bits should be stripped")
+	if !reflect.DeepEqual(NormalizeLangs([]string{"en-CA", "en"}), []string{"en-CA", "en"}) {
+		t.Fatalf("regions should be kept")
 	}
 	if !reflect.DeepEqual(NormalizeLangs([]string{"EN", "en"}), []string{"en"}) {
 		t.Fatalf("casing should be normalized")
 	}
+	if !reflect.DeepEqual(NormalizeLangs([]string{"pt-br", "PT-PT", "pt_BR"}), []string{"pt-BR", "pt-PT"}) {
+		t.Fatalf("regions should be kept apart, and normalized")
+	}
+	if !reflect.DeepEqual(NormalizeLangs([]string{"zh-hant", "zh-Hans", "ZH-HANT"}), []string{"zh-Hant", "zh-Hans"}) {
+		t.Fatalf("scripts should be kept apart, and normalized")
+	}
+	if !reflect.DeepEqual(NormalizeLangs([]string{"iw", "he"}), []string{"he"}) {
+		t.Fatalf("deprecated tags should be replaced")
+	}
+	if !reflect.DeepEqual(NormalizeLangs([]string{"english!", "x", "", "und", "ja"}), []string{"ja"}) {
+		t.Fatalf("malformed and undetermined tags should be dropped")
+	}
+}
+
+func TestListenKeys(t *testing.T) {
+	for lang, keys := range map[string][]string{
+		"en":             {"en"},
+		"pt-BR":          {"pt", "pt-Latn", "pt-BR", "pt-Latn-BR"},
+		"zh-Hant":        {"zh", "zh-Hant"},
+		"zh-TW":          {"zh", "zh-Hant", "zh-TW", "zh-Hant-TW"},
+		"en-GB-oxendict": {"en", "en-Latn", "en-GB", "en-Latn-GB", "en-GB-oxendict"},
+	} {
+		if got := ListenKeys(lang); !reflect.DeepEqual(got, keys) {
+			t.Errorf("%s: expected %#v, got %#v", lang, keys, got)
+		}
+	}
+}
+
+func TestBrowserLangs(t *testing.T) {
+	deref := func(langs []*string) []string {
+		out := []string{}
+		for _, lang := range langs {
+			out = append(out, *lang)
+		}
+		return out
+	}
+	for header, langs := range map[string][]string{
+		"":                                  {},
+		"en-US,en;q=0.9":                    {"en"},
+		"fr;q=0.5, pt-BR, zh-Hant-TW;q=0.8": {"pt", "zh", "fr"},
+		"*":                                 {},
+		"de-CH, not a language!!, de;q=0.1": {"de"},
+		"en;q=0.2, x!!, ja;q=0.9":           {"ja", "en"},
+	} {
+		if got := deref(browserLangs(header)); !reflect.DeepEqual(got, langs) {
+			t.Errorf("%#v: expected %#v, got %#v", header, langs, got)
+		}
+	}
 }
 
 func TestTopLangs(t *testing.T) {
-	if !reflect.DeepEqual(topLangs(0, map[string]int64{}), []string{}) {
+	if !reflect.DeepEqual(topLangs(map[string]float64{}), []string{}) {
 		t.Fatalf("empty map should yield empty slice")
 	}
-	if !reflect.DeepEqual(topLangs(1, map[string]int64{"en": 1}), []string{"en"}) {
+	if !reflect.DeepEqual(topLangs(map[string]float64{"en": 1}), []string{"en"}) {
 		t.Fatalf("lang seen is not dropped")
 	}
-	if !reflect.DeepEqual(topLangs(10_000, map[string]int64{"pt": 10_000, "en": 1}), []string{"pt"}) {
+	if !reflect.DeepEqual(topLangs(map[string]float64{"pt": 10_000, "en": 1}), []string{"pt"}) {
 		t.Fatalf("lang with too few sightings is dropped")
 	}
-	if !reflect.DeepEqual(topLangs(10_000, map[string]int64{
+	if !reflect.DeepEqual(topLangs(map[string]float64{
 		"en":   5_000,
 		"hu":   11,
 		"ja":   3_000,
@@ -86,4 +135,109 @@ func TestListeningFor(t *testing.T) {
 	if ListeningFor(map[string]bool{"en": true}, true, []string{"pt", "en", "ja"}) != true {
 		t.Fatalf("should here for any matching post lang")
 	}
+
+	if ListeningFor(map[string]bool{"pt": true}, false, []string{"pt-BR"}) != true {
+		t.Fatalf("base lang should hear its regions")
+	}
+	if ListeningFor(map[string]bool{"pt-BR": true}, false, []string{"pt-PT"}) != false {
+		t.Fatalf("region should not hear other regions")
+	}
+	if ListeningFor(map[string]bool{"pt-BR": true}, false, []string{"pt"}) != false {
+		t.Fatalf("region should not hear posts without a region")
+	}
+	if ListeningFor(map[string]bool{"zh-Hant": true}, false, []string{"zh-Hans"}) != false {
+		t.Fatalf("script should not hear other scripts")
+	}
+	if ListeningFor(map[string]bool{"zh-Hant": true}, false, []string{"zh-TW"}) != true {
+		t.Fatalf("script should hear regions that imply it")
+	}
+}
+
+func TestLangWindow(t *testing.T) {
+	start := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	w := newLangWindow(10*time.Minute, time.Minute, start)
+	for i := 0; i < 400; i++ {
+		w.add(LangEvent{Langs: []string{"en"}}, start)
+	}
+	for i := 0; i < 200; i++ {
+		w.add(LangEvent{Langs: []string{"pt"}}, start)
+	}
+	for i := 0; i < 30; i++ {
+		w.add(LangEvent{Langs: []string{"en"}, Deleted: true}, start)
+	}
+	for i := 0; i < 150; i++ {
+		w.add(LangEvent{Langs: []string{"pt"}, Deleted: true}, start)
+	}
+	w.add(LangEvent{Langs: []string{"en", "pt"}}, start.Add(5*time.Minute))
+	w.add(LangEvent{}, start.Add(5*time.Minute))
+
+	stats := w.stats(start.Add(9 * time.Minute))
+	if stats.WindowSeconds != 600 || stats.Posts != 602 || stats.Deletions != 180 {
+		t.Fatalf("unexpected totals %#v", stats)
+	}
+	if len(stats.Langs) != 3 || *stats.Langs[0].Lang != "en" || stats.Langs[0].Posts != 401 {
+		t.Fatalf("expected en first, got %#v", stats.Langs)
+	}
+	en, pt, unknown := stats.Langs[0], stats.Langs[1], stats.Langs[2]
+	if en.Unusual || !pt.Unusual {
+		t.Errorf("expected pt to be unusual (ratio %f vs %f), not en (%f)", pt.Ratio, stats.Ratio, en.Ratio)
+	}
+	if unknown.Lang != nil || unknown.Posts != 1 {
+		t.Errorf("expected posts without a language, got %#v", unknown)
+	}
+	if pt.Percent() != "74.6%" {
+		t.Errorf("unexpected percent %#v", pt.Percent())
+	}
+
+	// the first minute falls out of the window
+	stats = w.stats(start.Add(10 * time.Minute))
+	if stats.Posts != 2 || stats.Deletions != 0 || len(stats.Langs) != 3 {
+		t.Fatalf("expected only the later posts, got %#v", stats)
+	}
+	// and eventually everything does, even after a long idle
+	stats = w.stats(start.Add(3 * time.Hour))
+	if stats.Posts != 0 || len(stats.Langs) != 0 {
+		t.Fatalf("expected an empty window, got %#v", stats)
+	}
+	w.add(LangEvent{Langs: []string{"ja"}}, start.Add(3*time.Hour))
+	if stats = w.stats(start.Add(3 * time.Hour)); stats.Posts != 1 {
+		t.Fatalf("expected counting to continue, got %#v", stats)
+	}
+}
+
+func TestLangWindowCountsAtEventTime(t *testing.T) {
+	start := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	w := newLangWindow(10*time.Minute, time.Minute, start)
+	now := start.Add(20 * time.Minute)
+	// catching up after a restart
+	w.add(LangEvent{Langs: []string{"en"}, Deleted: true, At: now.Add(-time.Hour)}, now)
+	w.add(LangEvent{Langs: []string{"en"}, At: now.Add(-5 * time.Minute)}, now)
+	w.add(LangEvent{Langs: []string{"en"}, At: now.Add(time.Second)}, now)
+
+	stats := w.stats(now)
+	if stats.Posts != 2 || stats.Deletions != 0 {
+		t.Fatalf("expected events from before the window to be dropped, got %#v", stats)
+	}
+	// the late post falls out when its minute does
+	if stats = w.stats(now.Add(5*time.Minute - time.Second)); stats.Posts != 2 {
+		t.Fatalf("expected the late post still in the window, got %#v", stats)
+	}
+	if stats = w.stats(now.Add(5 * time.Minute)); stats.Posts != 1 {
+		t.Fatalf("expected the late post counted in its own minute, got %#v", stats)
+	}
+}
+
+func TestLangStatsUnusualNeedsPosts(t *testing.T) {
+	now := time.Now()
+	w := newLangWindow(time.Hour, time.Minute, now)
+	for i := 0; i < unusualMinPosts; i++ {
+		w.add(LangEvent{Langs: []string{"en"}}, now)
+	}
+	w.add(LangEvent{Langs: []string{"hu"}}, now)
+	w.add(LangEvent{Langs: []string{"hu"}, Deleted: true}, now)
+	for _, stat := range w.stats(now).Langs {
+		if stat.Unusual {
+			t.Errorf("expected too few posts to be unusual, got %#v", stat)
+		}
+	}
 }
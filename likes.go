@@ -16,6 +16,7 @@ var reqClient = http.Client{
 type LikedPersistedPost struct {
 	Post  *PersistedPost
 	Likes *uint32
+	Kind  DeletionKind
 }
 
 type LinksResult struct {
@@ -27,6 +28,7 @@ func GetLikes(uncovered UncoveredPost) LikedPersistedPost {
 	return LikedPersistedPost{
 		Post:  uncovered.Post,
 		Likes: likes,
+		Kind:  uncovered.Kind,
 	}
 }
 
@@ -41,7 +43,7 @@ func getLikes(did, rkey string) *uint32 {
 	query.Set("path", ".subject.uri")
 
 	uri := aggregatorBase + "?" + query.Encode()
-	req, err := http.NewRequest("GET", uri, nil);
+	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return nil
 	}
@@ -49,8 +51,8 @@ func getLikes(did, rkey string) *uint32 {
 
 	res, err := reqClient.Do(req)
 	if err != nil {
-		var urlErr url.Error
-		if errors.As(err, &urlErr.Err) && urlErr.Timeout() {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) && urlErr.Timeout() {
 			likeRequestFails.WithLabelValues("request timeout").Inc()
 		} else {
 			likeRequestFails.WithLabelValues("request error").Inc()
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// client messages allowed in a burst, refilling at the limits' MessageRate
+const observerMessageBurst = 10
+
+// ObserverLimits protects the websocket endpoint: which origins can connect,
+// how many connections one client (by IP) and everyone together can hold
+// open, and how fast a client can send messages.
+type ObserverLimits struct {
+	// browser origins allowed to connect, like "https://example.com", or "*"
+	// for any. empty = only pages from the same host. connections without an
+	// Origin (not from a browser) are always allowed.
+	AllowedOrigins []string
+	// peers whose Fly-Client-IP and X-Forwarded-For headers are believed
+	TrustedProxies []netip.Prefix
+	// 0 = unlimited
+	MaxPerIP int
+	MaxTotal int
+	// client messages per second, per IP
+	MessageRate float64
+
+	lock    sync.Mutex
+	perIP   map[string]int
+	total   int
+	buckets map[string]*tokenBucket
+}
+
+func NewObserverLimits(allowedOrigins []string, trustedProxies []netip.Prefix, maxPerIP, maxTotal int, messageRate float64) *ObserverLimits {
+	return &ObserverLimits{
+		AllowedOrigins: allowedOrigins,
+		TrustedProxies: trustedProxies,
+		MaxPerIP:       maxPerIP,
+		MaxTotal:       maxTotal,
+		MessageRate:    messageRate,
+		perIP:          map[string]int{},
+		buckets:        map[string]*tokenBucket{},
+	}
+}
+
+// ParseTrustedProxies reads a comma-separated list of CIDRs or single IPs
+func ParseTrustedProxies(value string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (l *ObserverLimits) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP finds who's connecting: the peer, unless the peer is a trusted
+// proxy, in which case whoever it says it's forwarding for
+func (l *ObserverLimits) ClientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !l.trusted(peer) {
+		return peer
+	}
+	if fly := strings.TrimSpace(r.Header.Get("Fly-Client-IP")); fly != "" {
+		if _, err := netip.ParseAddr(fly); err == nil {
+			return fly
+		}
+	}
+	// each proxy appends who it heard from: the first untrusted address from
+	// the right is the client, and anything left of it could be made up
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if _, err := netip.ParseAddr(ip); err != nil {
+			break
+		}
+		if !l.trusted(ip) {
+			return ip
+		}
+	}
+	return peer
+}
+
+// CheckOrigin is for websocket.Upgrader
+func (l *ObserverLimits) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	allowed := false
+	if len(l.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		allowed = err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range l.AllowedOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		rejectedConnectionsCounter.WithLabelValues("origin").Inc()
+	}
+	return allowed
+}
+
+// Acquire takes a connection slot for ip. if there's none, it returns why
+// not instead; otherwise release must be called once the connection ends.
+func (l *ObserverLimits) Acquire(ip string) (release func(), reason string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.MaxTotal > 0 && l.total >= l.MaxTotal {
+		rejectedConnectionsCounter.WithLabelValues("global_limit").Inc()
+		return nil, "global_limit"
+	}
+	if l.MaxPerIP > 0 && l.perIP[ip] >= l.MaxPerIP {
+		rejectedConnectionsCounter.WithLabelValues("ip_limit").Inc()
+		return nil, "ip_limit"
+	}
+	l.total += 1
+	l.perIP[ip] += 1
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(ip) })
+	}, ""
+}
+
+func (l *ObserverLimits) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total -= 1
+	l.perIP[ip] -= 1
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+		delete(l.buckets, ip)
+	}
+}
+
+// AllowMessage takes one client message from ip's rate limit
+func (l *ObserverLimits) AllowMessage(ip string, now time.Time) bool {
+	if l.MessageRate <= 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	bucket := l.buckets[ip]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: observerMessageBurst, last: now}
+		l.buckets[ip] = bucket
+	}
+	if !bucket.take(now, l.MessageRate, observerMessageBurst) {
+		rateLimitedMessagesCounter.Inc()
+		return false
+	}
+	return true
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
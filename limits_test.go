@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("failed to parse proxies: %#v", err)
+	}
+	limits := NewObserverLimits(nil, proxies, 0, 0, 0)
+	for _, tc := range []struct {
+		remote  string
+		headers map[string]string
+		expect  string
+	}{
+		{"1.2.3.4:5678", nil, "1.2.3.4"},
+		// untrusted peers can't claim to be anyone
+		{"1.2.3.4:5678", map[string]string{"Fly-Client-IP": "5.6.7.8"}, "1.2.3.4"},
+		{"1.2.3.4:5678", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"10.1.2.3:80", map[string]string{"Fly-Client-IP": "5.6.7.8"}, "5.6.7.8"},
+		{"10.1.2.3:80", map[string]string{"Fly-Client-IP": "nope", "X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		// the client can put anything at the start: take the rightmost untrusted
+		{"192.168.1.1:80", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"[::ffff:10.0.0.1]:80", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"10.1.2.3:80", map[string]string{"X-Forwarded-For": "garbage"}, "10.1.2.3"},
+		{"10.1.2.3:80", nil, "10.1.2.3"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if ip := limits.ClientIP(r); ip != tc.expect {
+			t.Errorf("%s with %#v: expected %#v, got %#v", tc.remote, tc.headers, tc.expect, ip)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/99"); err == nil {
+		t.Errorf("expected a bad prefix to fail")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := func(allowed []string, origin string) bool {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return NewObserverLimits(allowed, nil, 0, 0, 0).CheckOrigin(r)
+	}
+	for _, tc := range []struct {
+		allowed []string
+		origin  string
+		expect  bool
+	}{
+		{nil, "", true},
+		{nil, "http://example.com", true},
+		{nil, "https://elsewhere.com", false},
+		{[]string{"https://elsewhere.com/"}, "https://elsewhere.com", true},
+		{[]string{"https://elsewhere.com"}, "https://other.com", false},
+		{[]string{"https://elsewhere.com"}, "http://example.com", false},
+		{[]string{"*"}, "https://other.com", true},
+	} {
+		if got := check(tc.allowed, tc.origin); got != tc.expect {
+			t.Errorf("origin %#v allowing %#v: expected %v", tc.origin, tc.allowed, tc.expect)
+		}
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	limits := NewObserverLimits(nil, nil, 2, 3, 0)
+	a1, reason := limits.Acquire("a")
+	if reason != "" {
+		t.Fatalf("expected a slot, got %#v", reason)
+	}
+	limits.Acquire("a")
+	if _, reason := limits.Acquire("a"); reason != "ip_limit" {
+		t.Fatalf("expected ip_limit, got %#v", reason)
+	}
+	limits.Acquire("b")
+	if _, reason := limits.Acquire("c"); reason != "global_limit" {
+		t.Fatalf("expected global_limit, got %#v", reason)
+	}
+	a1()
+	a1() // only counts once
+	if _, reason := limits.Acquire("c"); reason != "" {
+		t.Fatalf("expected a slot after releasing, got %#v", reason)
+	}
+	if _, reason := limits.Acquire("a"); reason != "global_limit" {
+		t.Fatalf("expected global_limit, got %#v", reason)
+	}
+}
+
+func TestAllowMessage(t *testing.T) {
+	limits := NewObserverLimits(nil, nil, 0, 0, 2)
+	now := time.Now()
+	for i := 0; i < observerMessageBurst; i++ {
+		if !limits.AllowMessage("a", now) {
+			t.Fatalf("expected the burst to be allowed, stopped at %d", i)
+		}
+	}
+	if limits.AllowMessage("a", now) {
+		t.Fatalf("expected to be limited after the burst")
+	}
+	if !limits.AllowMessage("b", now) {
+		t.Fatalf("expected other ips to have their own limit")
+	}
+	if !limits.AllowMessage("a", now.Add(500*time.Millisecond)) {
+		t.Fatalf("expected a message after refilling")
+	}
+	if limits.AllowMessage("a", now.Add(500*time.Millisecond)) {
+		t.Fatalf("expected only one message to refill")
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	_, wsUrl := testServerWithLimits(t, NewObserverLimits(nil, nil, 1, 0, 0))
+
+	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	readObservers(t, c)
+	_, res, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a second connection to be refused, got %#v", err)
+	}
+	c.Close()
+
+	// the slot is given back when the connection ends
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, _, err = websocket.DefaultDialer.Dial(wsUrl, nil)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected to reconnect after closing, got %#v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer c.Close()
+
+	header := http.Header{"Origin": {"https://elsewhere.com"}}
+	if _, _, err := websocket.DefaultDialer.Dial(wsUrl, header); err == nil {
+		t.Fatalf("expected a foreign origin to be refused")
+	}
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	_, wsUrl := testServerWithLimits(t, NewObserverLimits(nil, nil, 0, 0, 0.001))
+	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	defer c.Close()
+
+	for i := 0; i <= observerMessageBurst; i++ {
+		c.WriteJSON(ClientMessage{Type: "setFilter", ID: "f", Filter: &ObserverFilter{}})
+	}
+	acks := 0
+	for {
+		var message ErrorMessage
+		if err := c.ReadJSON(&message); err != nil {
+			t.Fatalf("failed to read: %#v", err)
+		}
+		switch message.Type {
+		case "ack":
+			acks += 1
+		case "error":
+			if message.Code != ErrorRateLimited || message.ID != "f" {
+				t.Fatalf("expected a rate_limited error, got %#v", message)
+			}
+			if acks != observerMessageBurst {
+				t.Fatalf("expected %d acks first, got %d", observerMessageBurst, acks)
+			}
+			return
+		}
+	}
+}
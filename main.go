@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"log"
 	"log/slog"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(CacheCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	env := os.Getenv("ENV")
 	if env == "" {
 		env = "development"
@@ -30,6 +39,72 @@ func main() {
 		dbPath = "./posts-cache.db"
 	}
 
+	// seeds an empty cache from another instance's snapshot: see snapshot.go
+	restoreFrom := os.Getenv("RESTORE_FROM")
+
+	// guards /admin endpoints. unset = they're disabled
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
+	// websocket origins allowed besides our own pages, comma-separated, or "*"
+	allowedOrigins := []string{}
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowedOrigins = append(allowedOrigins, origin)
+		}
+	}
+
+	// proxies in front of us, whose client ip headers we believe. unset = none
+	trustedProxies, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("failed to parse TRUSTED_PROXIES: %s", err)
+	}
+
+	// who may put /embed in an iframe, as CSP sources. unset = only our pages
+	frameAncestors, err := ParseFrameAncestors(os.Getenv("FRAME_ANCESTORS"))
+	if err != nil {
+		log.Fatalf("failed to parse FRAME_ANCESTORS: %s", err)
+	}
+
+	parseLimit := func(name string, fallback int) int {
+		value := os.Getenv(name)
+		if value == "" {
+			return fallback
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("failed to parse %s: %s", name, err)
+		}
+		return n
+	}
+	// 0 = unlimited. the most one cpu keeps up with, see broadcast.go
+	maxObservers := parseLimit("MAX_OBSERVERS", 5_000)
+	maxObserversPerIP := parseLimit("MAX_OBSERVERS_PER_IP", 8)
+	observerMessageRate := float64(parseLimit("OBSERVER_MESSAGES_PER_SECOND", 2))
+
+	storageProfile, err := GetStorageProfile(os.Getenv("CACHE_PROFILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// disk budget for the post cache. unset = no budget: always keep the max
+	var cacheTargetBytes uint64
+	if target := os.Getenv("CACHE_TARGET_MB"); target != "" {
+		mb, err := strconv.ParseUint(target, 10, 64)
+		if err != nil {
+			log.Fatalf("failed to parse CACHE_TARGET_MB: %s", err)
+		}
+		cacheTargetBytes = mb * 1024 * 1024
+	}
+
+	minRetention := envDuration("CACHE_MIN_RETENTION", "6h")
+	maxRetention := envDuration("CACHE_MAX_RETENTION", "48h")
+	if minRetention > maxRetention {
+		log.Fatalf("CACHE_MIN_RETENTION (%s) is longer than CACHE_MAX_RETENTION (%s)", minRetention, maxRetention)
+	}
+
+	// how quickly languages fall out of the language filter when quiet
+	langsHalfLife := envDuration("LANGS_HALF_LIFE", "6h")
+
 	ctx := context.TODO()
 
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
@@ -38,7 +113,41 @@ func main() {
 	})))
 	logger := slog.Default()
 
-	deletedFeed, languagesFeed := Consume(ctx, env, jsUrl, dbPath, logger)
-	topLangsFeed := CountLangs(languagesFeed)
-	Serve(env, port, host, deletedFeed, topLangsFeed)
+	if restoreFrom != "" {
+		if err := RestoreOnBoot(restoreFrom, dbPath, adminToken); err != nil {
+			// an empty cache fills up again eventually: better than not starting
+			logger.Error("failed to restore cache snapshot, starting empty", "error", err)
+		}
+	}
+
+	retention := NewRetentionController(cacheTargetBytes, minRetention, maxRetention)
+	postHandler, deletedFeed, languagesFeed := Consume(ctx, env, jsUrl, dbPath, storageProfile, retention, logger)
+	popularity, err := LoadLangPopularity(postHandler.DB, langsHalfLife, time.Now())
+	if err != nil {
+		logger.Error("failed to load language popularity, starting over", "error", err)
+		popularity = NewLangPopularity(langsHalfLife, time.Now())
+	}
+	langStatsFeed := CountLangs(languagesFeed, popularity, postHandler.DB)
+
+	admin := http.NewServeMux()
+	admin.Handle("GET /admin/snapshot", SnapshotHandler(postHandler, adminToken))
+	reports := NewErrorReports()
+	admin.Handle("GET /admin/oops", ErrorReportsHandler(reports, adminToken))
+
+	limits := NewObserverLimits(allowedOrigins, trustedProxies, maxObserversPerIP, maxObservers, observerMessageRate)
+
+	Serve(env, port, host, limits, frameAncestors, reports, admin, deletedFeed, langStatsFeed)
+}
+
+// envDuration reads a duration from the environment, or the default if unset
+func envDuration(name, fallback string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		value = fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", name, err)
+	}
+	return d
 }
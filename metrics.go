@@ -1,9 +1,14 @@
 package main
 
 import (
+	"github.com/cockroachdb/pebble"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var postCacheDepth = promauto.NewGauge(prometheus.GaugeOpts{
@@ -11,6 +16,11 @@ var postCacheDepth = promauto.NewGauge(prometheus.GaugeOpts{
 	Help: "Seconds since the oldest item was created",
 })
 
+var retentionGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "post_cache_retention",
+	Help: "Seconds of posts currently kept in the cache before trimming",
+})
+
 var postCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "posts",
 	Help: "Count of new posts",
@@ -26,6 +36,21 @@ var postDeleteCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Count of deleted posts, lang and target only available for cach hits",
 }, []string{"lang", "target", "cache"})
 
+var postDeleteKindCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "post_deletes_kind",
+	Help: "Count of all deleted posts (hits and misses) by bulk or organic deletion",
+}, []string{"kind"})
+
+var accountEventCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "account_events",
+	Help: "Count of account status events by status and what we did about them",
+}, []string{"status", "outcome"})
+
+var accountPostsPurgedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "account_posts_purged",
+	Help: "Cached posts dropped without broadcasting because their account went away",
+}, []string{"status"})
+
 func rounded(buckets []float64) []float64 {
 	// the number of seconds is always ~large, so rounding has minimal effect
 	// while labels on graphs are nicer
@@ -47,7 +72,192 @@ var observersCount = promauto.NewGauge(prometheus.GaugeOpts{
 	Help: "Number of people observing the deleted posts",
 })
 
+var observerDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "observer_messages_dropped",
+	Help: "Messages dropped from full observer queues",
+})
+
+var observerStuckCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "observers_disconnected_stuck",
+	Help: "Observers disconnected because their queue stayed full",
+})
+
+var rejectedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "observer_connections_rejected",
+	Help: "Websocket connections refused, by reason",
+}, []string{"reason"})
+
+var rateLimitedMessagesCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "observer_messages_rate_limited",
+	Help: "Client messages ignored for going over the rate limit",
+})
+
+var clientErrorCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "client_error_reports",
+	Help: "Error reports from browsers, by javascript error kind",
+}, []string{"kind"})
+
+var clientErrorRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "client_error_reports_rejected",
+	Help: "Error reports refused, by reason",
+}, []string{"reason"})
+
+var langDetectionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "post_language_detection",
+	Help: "Language guesses for posts without a declared language, by result",
+}, []string{"result"})
+
 var likeRequestFails = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "post_like_request_fails",
 	Help: "Failures to fetch likes for a post from atproto-link-aggregator",
 }, []string{"reason"})
+
+var cacheOpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "post_cache_op_duration",
+	Help:    "Seconds taken by post cache operations",
+	Buckets: prometheus.ExponentialBuckets(0.00005, 4, 10),
+}, []string{"op"})
+
+// observeCacheOp is for deferring at the top of a cache operation:
+// defer observeCacheOp("take", time.Now())
+func observeCacheOp(op string, start time.Time) {
+	cacheOpDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+var pebbleWriteStalls = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pebble_write_stalls",
+	Help: "Count of times pebble intentionally delayed writes",
+})
+
+var pebbleWriteStallDuration = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pebble_write_stall_seconds",
+	Help: "Total seconds pebble spent with writes stalled",
+})
+
+// pebbleEventListener feeds write stalls into metrics. pebble only reports
+// them as events, not in DB.Metrics().
+func pebbleEventListener() *pebble.EventListener {
+	var stallLock sync.Mutex
+	var stallStart time.Time
+	return &pebble.EventListener{
+		WriteStallBegin: func(info pebble.WriteStallBeginInfo) {
+			stallLock.Lock()
+			defer stallLock.Unlock()
+			stallStart = time.Now()
+			pebbleWriteStalls.Inc()
+		},
+		WriteStallEnd: func() {
+			stallLock.Lock()
+			defer stallLock.Unlock()
+			if !stallStart.IsZero() {
+				pebbleWriteStallDuration.Add(time.Since(stallStart).Seconds())
+				stallStart = time.Time{}
+			}
+		},
+	}
+}
+
+// reading every sstable's properties for the key estimate is too much for
+// every scrape of a cache this size
+var pebbleKeysRefresh time.Duration = MustParseDuration("10m")
+
+// pebbleCollector exposes the storage engine's own metrics on each scrape.
+// the key estimate is from the last RefreshKeys.
+type pebbleCollector struct {
+	db *pebble.DB
+	// -1 until the first RefreshKeys
+	keysEstimate atomic.Int64
+
+	keys              *prometheus.Desc
+	diskUsage         *prometheus.Desc
+	compactionDebt    *prometheus.Desc
+	compactionsActive *prometheus.Desc
+	memtableSize      *prometheus.Desc
+	memtableCount     *prometheus.Desc
+	readAmp           *prometheus.Desc
+	levelFiles        *prometheus.Desc
+	levelSize         *prometheus.Desc
+	blockCacheSize    *prometheus.Desc
+	blockCacheHits    *prometheus.Desc
+	blockCacheMisses  *prometheus.Desc
+	walSize           *prometheus.Desc
+}
+
+func NewPebbleCollector(db *pebble.DB) *pebbleCollector {
+	c := &pebbleCollector{
+		db:                db,
+		keys:              prometheus.NewDesc("pebble_keys_estimate", "Estimated live keys in sstables (entries minus point deletions, memtables excluded)", nil, nil),
+		diskUsage:         prometheus.NewDesc("pebble_disk_usage_bytes", "Bytes on disk used by pebble", nil, nil),
+		compactionDebt:    prometheus.NewDesc("pebble_compaction_debt_bytes", "Estimated bytes that need compacting to reach a stable state", nil, nil),
+		compactionsActive: prometheus.NewDesc("pebble_compactions_in_progress", "Compactions currently running", nil, nil),
+		memtableSize:      prometheus.NewDesc("pebble_memtable_size_bytes", "Bytes allocated to memtables", nil, nil),
+		memtableCount:     prometheus.NewDesc("pebble_memtables", "Count of memtables", nil, nil),
+		readAmp:           prometheus.NewDesc("pebble_read_amplification", "Sublevels and levels a point read may have to check", nil, nil),
+		levelFiles:        prometheus.NewDesc("pebble_level_files", "Count of sstables per level", []string{"level"}, nil),
+		levelSize:         prometheus.NewDesc("pebble_level_size_bytes", "Bytes of sstables per level", []string{"level"}, nil),
+		blockCacheSize:    prometheus.NewDesc("pebble_block_cache_size_bytes", "Bytes in the block cache", nil, nil),
+		blockCacheHits:    prometheus.NewDesc("pebble_block_cache_hits", "Block cache hits", nil, nil),
+		blockCacheMisses:  prometheus.NewDesc("pebble_block_cache_misses", "Block cache misses", nil, nil),
+		walSize:           prometheus.NewDesc("pebble_wal_size_bytes", "Bytes of live write-ahead log", nil, nil),
+	}
+	c.keysEstimate.Store(-1)
+	return c
+}
+
+// RefreshKeys recounts the key estimate. the only key count pebble has is in
+// sstable properties.
+func (c *pebbleCollector) RefreshKeys() error {
+	tables, err := c.db.SSTables(pebble.WithProperties())
+	if err != nil {
+		return err
+	}
+	var keys int64
+	for _, level := range tables {
+		for _, table := range level {
+			if table.Properties != nil {
+				keys += int64(table.Properties.NumEntries) - int64(table.Properties.NumDeletions)
+			}
+		}
+	}
+	c.keysEstimate.Store(max(keys, 0))
+	return nil
+}
+
+// described up front, since the key estimate isn't collected until it's counted
+func (c *pebbleCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.keys, c.diskUsage, c.compactionDebt, c.compactionsActive,
+		c.memtableSize, c.memtableCount, c.readAmp, c.levelFiles, c.levelSize,
+		c.blockCacheSize, c.blockCacheHits, c.blockCacheMisses, c.walSize,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *pebbleCollector) Collect(ch chan<- prometheus.Metric) {
+	m := c.db.Metrics()
+	gauge := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v, labels...)
+	}
+
+	gauge(c.diskUsage, float64(m.DiskSpaceUsage()))
+	gauge(c.compactionDebt, float64(m.Compact.EstimatedDebt))
+	gauge(c.compactionsActive, float64(m.Compact.NumInProgress))
+	gauge(c.memtableSize, float64(m.MemTable.Size))
+	gauge(c.memtableCount, float64(m.MemTable.Count))
+	gauge(c.readAmp, float64(m.ReadAmp()))
+	for level, lm := range m.Levels {
+		gauge(c.levelFiles, float64(lm.NumFiles), strconv.Itoa(level))
+		gauge(c.levelSize, float64(lm.Size), strconv.Itoa(level))
+	}
+	gauge(c.blockCacheSize, float64(m.BlockCache.Size))
+	counter(c.blockCacheHits, float64(m.BlockCache.Hits))
+	counter(c.blockCacheMisses, float64(m.BlockCache.Misses))
+	gauge(c.walSize, float64(m.WAL.Size))
+	if keys := c.keysEstimate.Load(); keys >= 0 {
+		gauge(c.keys, float64(keys))
+	}
+}
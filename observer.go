@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+const observerQueueSize = 64
+
+// an observer whose queue has stayed full this long isn't reading anymore
+var observerStuckTimeout time.Duration = MustParseDuration("30s")
+
+// observer is the broadcaster's side of one websocket client: a bounded queue
+// of messages waiting for its notify loop. when the queue is full the oldest
+// message is dropped, and the client is told how many it missed, so a slow
+// connection loses a few posts instead of getting disconnected.
+//
+// posts are checked against the observer's filter before they're queued, so
+// only posts it wants take up room (and count as dropped).
+type observer struct {
+	conn *websocket.Conn
+	enc  *Encoding
+	// set by the broadcaster when the observer joins
+	shard *broadcastShard
+	// its filter. set before it joins, then owned by its shard
+	matcher *filterMatcher
+	// who's connected, for rate limits
+	ip string
+	// gives back its connection slot (see ObserverLimits.Acquire)
+	release func()
+
+	lock       sync.Mutex
+	queue      []queuedMessage
+	dropped    int
+	stuckSince time.Time
+	// the queue's other buffer: what the last take handed out. the notify
+	// loop is done with it by the time it takes again, so the two swap
+	// instead of a new queue for every take.
+	taken []queuedMessage
+
+	// a message is waiting (buffered, size 1)
+	wake chan struct{}
+	// closed when the broadcaster removes the observer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// queuedMessage is a message that passed the observer's filter, with the
+// post's highlights for it, if any
+type queuedMessage struct {
+	*broadcastMessage
+	highlights []Highlight
+}
+
+func newObserver(conn *websocket.Conn) *observer {
+	everything, _ := ObserverFilter{}.Matcher()
+	return &observer{
+		conn:    conn,
+		enc:     JsonEncoding,
+		matcher: everything,
+		queue:   make([]queuedMessage, 0, observerQueueSize),
+		taken:   make([]queuedMessage, 0, observerQueueSize),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// push queues a message, dropping the oldest if the queue is full. it reports
+// whether the queue has been full for longer than observerStuckTimeout.
+func (o *observer) push(message *broadcastMessage, highlights []Highlight, now time.Time) (stuck bool) {
+	o.lock.Lock()
+	if len(o.queue) >= observerQueueSize {
+		o.queue = append(o.queue[:0], o.queue[1:]...)
+		o.dropped += 1
+		observerDroppedCounter.Inc()
+		if o.stuckSince.IsZero() {
+			o.stuckSince = now
+		}
+	}
+	o.queue = append(o.queue, queuedMessage{message, highlights})
+	stuck = !o.stuckSince.IsZero() && now.Sub(o.stuckSince) > observerStuckTimeout
+	o.lock.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default: // already awake
+	}
+	return stuck
+}
+
+// take empties the queue, returning its messages and how many were dropped
+// since the last take. the messages are only good until the next take.
+func (o *observer) take() ([]queuedMessage, int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	messages := o.queue
+	dropped := o.dropped
+	clear(o.taken) // don't hold on to sent messages
+	o.queue, o.taken = o.taken[:0], messages
+	o.dropped = 0
+	o.stuckSince = time.Time{}
+	return messages, dropped
+}
+
+// close stops the observer's notify loop and closes its socket, which ends
+// its listen loop too. only the first call does anything, and returns true.
+func (o *observer) close() bool {
+	closed := false
+	o.closeOnce.Do(func() {
+		closed = true
+		close(o.done)
+		if o.conn != nil {
+			o.conn.Close()
+		}
+	})
+	return closed
+}
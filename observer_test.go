@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func observersMessage(n int) *broadcastMessage {
+	return &broadcastMessage{message: ObserverMessage{Type: ObserverMessageTypeObservers, ObserversCount: n}}
+}
+
+func TestObserverDropsOldest(t *testing.T) {
+	o := newObserver(nil)
+	now := time.Now()
+	for i := 0; i < observerQueueSize+3; i++ {
+		if o.push(observersMessage(i), nil, now) {
+			t.Fatalf("shouldn't be stuck right away")
+		}
+	}
+	messages, dropped := o.take()
+	if dropped != 3 {
+		t.Fatalf("expected 3 dropped, got %d", dropped)
+	}
+	if len(messages) != observerQueueSize || messages[0].message.ObserversCount != 3 {
+		t.Fatalf("expected the newest %d messages, got %d starting at %d",
+			observerQueueSize, len(messages), messages[0].message.ObserversCount)
+	}
+	if messages, dropped := o.take(); len(messages) != 0 || dropped != 0 {
+		t.Fatalf("take should empty the queue")
+	}
+}
+
+func TestObserverStuck(t *testing.T) {
+	o := newObserver(nil)
+	start := time.Now()
+	for i := 0; i < observerQueueSize+1; i++ {
+		o.push(observersMessage(i), nil, start)
+	}
+	if o.push(observersMessage(0), nil, start.Add(observerStuckTimeout/2)) {
+		t.Fatalf("shouldn't be stuck before the timeout")
+	}
+	if !o.push(observersMessage(0), nil, start.Add(observerStuckTimeout*2)) {
+		t.Fatalf("should be stuck after the queue stays full past the timeout")
+	}
+
+	o.take() // it caught up
+	later := start.Add(observerStuckTimeout * 3)
+	for i := 0; i < observerQueueSize+1; i++ {
+		if o.push(observersMessage(i), nil, later) {
+			t.Fatalf("catching up should reset being stuck")
+		}
+	}
+}
+
+func TestObserverClose(t *testing.T) {
+	o := newObserver(nil)
+	o.close()
+	o.close() // no panic
+	select {
+	case <-o.done:
+	default:
+		t.Fatalf("done should be closed")
+	}
+}
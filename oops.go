@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// client error reports come from window.onerror in index.html. anyone can
+// post them, so they're small, rate-limited, and only logged the first time.
+
+const (
+	maxOopsBytes   = 16 << 10
+	maxOopsMessage = 1_000 // characters
+	maxOopsSource  = 1_000
+	maxOopsStack   = 8_000
+	// distinct reports kept for /admin/oops
+	maxRecentOops = 100
+	// per IP: a burst of reports, then one every oopsInterval
+	oopsBurst = 5
+	// ip buckets kept before forgetting the idle ones
+	maxOopsBuckets = 10_000
+)
+
+var oopsInterval time.Duration = MustParseDuration("12s")
+
+// ErrorReport is what the page sends about an uncaught error
+type ErrorReport struct {
+	Message string `json:"message"`
+	Source  string `json:"source"`
+	Line    int    `json:"lineno"`
+	Column  int    `json:"colno"`
+	Stack   string `json:"stack"`
+}
+
+// javascript's error names, for the metric. anything else is "other".
+var errorKinds = map[string]bool{
+	"Error":          true,
+	"AggregateError": true,
+	"EvalError":      true,
+	"InternalError":  true,
+	"RangeError":     true,
+	"ReferenceError": true,
+	"SyntaxError":    true,
+	"TypeError":      true,
+	"URIError":       true,
+	"DOMException":   true,
+}
+
+var errorKindPattern = regexp.MustCompile(`\b([A-Z][A-Za-z]*(?:Error|Exception))\b`)
+
+// Kind guesses the error's class from its message, like "Uncaught TypeError: ..."
+func (er ErrorReport) Kind() string {
+	if match := errorKindPattern.FindStringSubmatch(er.Message); match != nil && errorKinds[match[1]] {
+		return match[1]
+	}
+	return "other"
+}
+
+func (er ErrorReport) Validate() error {
+	if strings.TrimSpace(er.Message) == "" {
+		return errors.New("missing message")
+	}
+	if er.Line < 0 || er.Column < 0 {
+		return errors.New("bad position")
+	}
+	if utf8.RuneCountInString(er.Message) > maxOopsMessage ||
+		utf8.RuneCountInString(er.Source) > maxOopsSource ||
+		utf8.RuneCountInString(er.Stack) > maxOopsStack {
+		return errors.New("too long")
+	}
+	return nil
+}
+
+// same error from the same place: the stack and user agent don't count
+type errorReportKey struct {
+	message string
+	source  string
+	line    int
+	column  int
+}
+
+// RecentErrorReport is one distinct report, as listed on /admin/oops
+type RecentErrorReport struct {
+	ErrorReport
+	Kind      string    `json:"kind"`
+	UserAgent string    `json:"ua"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// ErrorReports deduplicates client error reports and keeps the recent ones
+type ErrorReports struct {
+	lock    sync.Mutex
+	recent  map[errorReportKey]*RecentErrorReport
+	buckets map[string]*tokenBucket
+}
+
+func NewErrorReports() *ErrorReports {
+	return &ErrorReports{
+		recent:  map[errorReportKey]*RecentErrorReport{},
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes one report from ip's rate limit
+func (reports *ErrorReports) allow(ip string, now time.Time) bool {
+	reports.lock.Lock()
+	defer reports.lock.Unlock()
+	rate := 1 / oopsInterval.Seconds()
+	bucket := reports.buckets[ip]
+	if bucket == nil {
+		if len(reports.buckets) >= maxOopsBuckets {
+			// anyone idle long enough to be refilled is the same as new
+			for other, b := range reports.buckets {
+				if now.Sub(b.last) > oopsInterval*oopsBurst {
+					delete(reports.buckets, other)
+				}
+			}
+		}
+		if len(reports.buckets) >= maxOopsBuckets {
+			return false
+		}
+		bucket = &tokenBucket{tokens: oopsBurst, last: now}
+		reports.buckets[ip] = bucket
+	}
+	return bucket.take(now, rate, oopsBurst)
+}
+
+// add records a report, and returns whether it's new
+func (reports *ErrorReports) add(report ErrorReport, ua string, now time.Time) bool {
+	reports.lock.Lock()
+	defer reports.lock.Unlock()
+	key := errorReportKey{report.Message, report.Source, report.Line, report.Column}
+	if seen := reports.recent[key]; seen != nil {
+		seen.Count += 1
+		seen.LastSeen = now
+		return false
+	}
+	if len(reports.recent) >= maxRecentOops {
+		var oldest errorReportKey
+		var oldestSeen time.Time
+		for k, seen := range reports.recent {
+			if oldestSeen.IsZero() || seen.LastSeen.Before(oldestSeen) {
+				oldest, oldestSeen = k, seen.LastSeen
+			}
+		}
+		delete(reports.recent, oldest)
+	}
+	reports.recent[key] = &RecentErrorReport{
+		ErrorReport: report,
+		Kind:        report.Kind(),
+		UserAgent:   ua,
+		Count:       1,
+		FirstSeen:   now,
+		LastSeen:    now,
+	}
+	return true
+}
+
+// Recent lists the distinct reports, most recently seen first
+func (reports *ErrorReports) Recent() []RecentErrorReport {
+	reports.lock.Lock()
+	defer reports.lock.Unlock()
+	recent := make([]RecentErrorReport, 0, len(reports.recent))
+	for _, seen := range reports.recent {
+		recent = append(recent, *seen)
+	}
+	slices.SortFunc(recent, func(a, b RecentErrorReport) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return recent
+}
+
+func (s *Server) oops(w http.ResponseWriter, r *http.Request) {
+	if !s.reports.allow(s.limits.ClientIP(r), time.Now()) {
+		clientErrorRejectedCounter.WithLabelValues("rate_limited").Inc()
+		http.Error(w, "too many reports", http.StatusTooManyRequests)
+		return
+	}
+
+	var report ErrorReport
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOopsBytes))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&report); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			clientErrorRejectedCounter.WithLabelValues("too_large").Inc()
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		clientErrorRejectedCounter.WithLabelValues("invalid").Inc()
+		http.Error(w, "bad report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := report.Validate(); err != nil {
+		clientErrorRejectedCounter.WithLabelValues("invalid").Inc()
+		http.Error(w, "bad report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientErrorCounter.WithLabelValues(report.Kind()).Inc()
+	if s.reports.add(report, r.UserAgent(), time.Now()) {
+		jsonData, _ := json.Marshal(report)
+		log.Println("client error report", string(jsonData), r.UserAgent())
+	}
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, "got it. and sorry :/")
+}
+
+// ErrorReportsHandler lists recent distinct client error reports as json
+func ErrorReportsHandler(reports *ErrorReports, adminToken string) http.HandlerFunc {
+	return adminOnly(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports.Recent())
+	})
+}
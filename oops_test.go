@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorReportKind(t *testing.T) {
+	for message, kind := range map[string]string{
+		"Uncaught TypeError: x is undefined":      "TypeError",
+		"ReferenceError: y is not defined":        "ReferenceError",
+		"Uncaught DOMException: failed":           "DOMException",
+		"Uncaught SomethingMadeUpError: whatever": "other",
+		"Script error.":                           "other",
+	} {
+		if got := (ErrorReport{Message: message}).Kind(); got != kind {
+			t.Errorf("%#v: expected %#v, got %#v", message, kind, got)
+		}
+	}
+}
+
+func TestOops(t *testing.T) {
+	server := newServer(NewObserverLimits(nil, nil, 0, 0, 0), nil, NewErrorReports())
+	post := func(body string, ip string) int {
+		r := httptest.NewRequest("POST", "/oops", strings.NewReader(body))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		server.oops(w, r)
+		return w.Code
+	}
+
+	report := `{"message":"Uncaught TypeError: x","source":"/","lineno":1,"colno":2,"stack":"at /:1:2"}`
+	if code := post(report, "1.1.1.1"); code != http.StatusCreated {
+		t.Fatalf("expected a report to be accepted, got %d", code)
+	}
+	for body, expect := range map[string]int{
+		`{"message":"x","extra":1}`: http.StatusBadRequest,
+		`{"source":"/"}`:            http.StatusBadRequest,
+		`not json`:                  http.StatusBadRequest,
+		`{"message":"` + strings.Repeat("x", 2000) + `"}`:         http.StatusBadRequest,
+		`{"message":"` + strings.Repeat("x", maxOopsBytes) + `"}`: http.StatusRequestEntityTooLarge,
+	} {
+		if code := post(body, "2.2.2.2"); code != expect {
+			t.Errorf("%.40s: expected %d, got %d", body, expect, code)
+		}
+	}
+
+	// the same error again with a different stack is a duplicate
+	post(`{"message":"Uncaught TypeError: x","source":"/","lineno":1,"colno":2,"stack":"elsewhere"}`, "3.3.3.3")
+	post(`{"message":"Uncaught RangeError: y"}`, "3.3.3.3")
+	recent := server.reports.Recent()
+	if len(recent) != 2 {
+		t.Fatalf("expected 2 distinct reports, got %#v", recent)
+	}
+	if recent[1].Kind != "TypeError" || recent[1].Count != 2 || recent[1].Stack != "at /:1:2" {
+		t.Errorf("expected the first report counted twice, got %#v", recent[1])
+	}
+	if recent[0].Kind != "RangeError" {
+		t.Errorf("expected the latest report first, got %#v", recent[0])
+	}
+
+	// the bad ones above used up most of this ip's burst
+	limited := false
+	for i := 0; i < oopsBurst; i++ {
+		if post(report, "2.2.2.2") == http.StatusTooManyRequests {
+			limited = true
+		}
+	}
+	if !limited {
+		t.Errorf("expected reports to be rate-limited")
+	}
+	if code := post(report, "4.4.4.4"); code != http.StatusCreated {
+		t.Errorf("expected other ips to have their own limit, got %d", code)
+	}
+}
+
+func TestRecentErrorReportsBounded(t *testing.T) {
+	reports := NewErrorReports()
+	now := time.Now()
+	for i := 0; i < maxRecentOops+10; i++ {
+		report := ErrorReport{Message: "Error", Line: i}
+		reports.add(report, "", now.Add(time.Duration(i)*time.Second))
+	}
+	recent := reports.Recent()
+	if len(recent) != maxRecentOops {
+		t.Fatalf("expected %d reports, got %d", maxRecentOops, len(recent))
+	}
+	if recent[len(recent)-1].Line != 10 {
+		t.Errorf("expected the oldest reports to be forgotten, got line %d", recent[len(recent)-1].Line)
+	}
+}
+
+func TestErrorReportsHandler(t *testing.T) {
+	reports := NewErrorReports()
+	reports.add(ErrorReport{Message: "TypeError: x"}, "firefox", time.Now())
+	handler := ErrorReportsHandler(reports, "secret")
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/admin/oops", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/admin/oops", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	var recent []RecentErrorReport
+	if err := json.NewDecoder(w.Body).Decode(&recent); err != nil {
+		t.Fatalf("failed to decode: %#v", err)
+	}
+	if len(recent) != 1 || recent[0].UserAgent != "firefox" || recent[0].Kind != "TypeError" {
+		t.Errorf("unexpected reports %#v", recent)
+	}
+}
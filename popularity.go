@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"math"
+	"time"
+)
+
+// known languages come from how many posts each language has had lately:
+// every post counts 1, and counts halve every half-life. the counts are saved
+// in the cache db now and then, so the language list survives restarts.
+
+// languages tracked at once: past this, the least popular are forgotten
+const maxTrackedLangs = 500
+
+// decayed counts below this are forgotten
+const minLangPopularity = 0.01
+
+var langsKey = []byte("meta/langs")
+
+var langsSaveInterval time.Duration = MustParseDuration("1m")
+
+type LangPopularity struct {
+	HalfLife time.Duration
+	counts   map[string]float64
+	// when counts were last decayed
+	at time.Time
+}
+
+// saved in the db at langsKey
+type langPopularitySnapshot struct {
+	At     time.Time          `json:"at"`
+	Counts map[string]float64 `json:"counts"`
+}
+
+func NewLangPopularity(halfLife time.Duration, now time.Time) *LangPopularity {
+	return &LangPopularity{
+		HalfLife: halfLife,
+		counts:   map[string]float64{},
+		at:       now,
+	}
+}
+
+// Add counts a post. counts added since the last decay aren't decayed yet,
+// which is fine for a half-life much longer than the update interval.
+func (p *LangPopularity) Add(lang string) {
+	if _, ok := p.counts[lang]; !ok && len(p.counts) >= maxTrackedLangs {
+		least, leastCount := p.leastPopular()
+		if leastCount > 1 {
+			return // everything tracked is more popular than a new language
+		}
+		delete(p.counts, least)
+	}
+	p.counts[lang] += 1
+}
+
+func (p *LangPopularity) leastPopular() (string, float64) {
+	least, leastCount := "", math.Inf(1)
+	for lang, count := range p.counts {
+		if count < leastCount {
+			least, leastCount = lang, count
+		}
+	}
+	return least, leastCount
+}
+
+func (p *LangPopularity) Decay(now time.Time) {
+	elapsed := now.Sub(p.at)
+	if elapsed <= 0 {
+		return
+	}
+	factor := math.Exp2(-elapsed.Seconds() / p.HalfLife.Seconds())
+	for lang, count := range p.counts {
+		if count *= factor; count < minLangPopularity {
+			delete(p.counts, lang)
+		} else {
+			p.counts[lang] = count
+		}
+	}
+	p.at = now
+}
+
+// Top is the known languages, most popular first
+func (p *LangPopularity) Top(now time.Time) []string {
+	p.Decay(now)
+	return topLangs(p.counts)
+}
+
+func (p *LangPopularity) Save(db *pebble.DB) error {
+	data, err := json.Marshal(langPopularitySnapshot{At: p.at, Counts: p.counts})
+	if err != nil {
+		return err
+	}
+	return db.Set(langsKey, data, pebble.NoSync)
+}
+
+// LoadLangPopularity picks up the saved counts, decayed for the time since,
+// or starts fresh
+func LoadLangPopularity(db *pebble.DB, halfLife time.Duration, now time.Time) (*LangPopularity, error) {
+	p := NewLangPopularity(halfLife, now)
+	data, closer, err := db.Get(langsKey)
+	if err == pebble.ErrNotFound {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	var snapshot langPopularitySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("bad saved language counts: %w", err)
+	}
+	if snapshot.At.After(now) {
+		snapshot.At = now
+	}
+	for lang, count := range snapshot.Counts {
+		p.counts[lang] = count
+	}
+	p.at = snapshot.At
+	p.Decay(now)
+	for len(p.counts) > maxTrackedLangs {
+		least, _ := p.leastPopular()
+		delete(p.counts, least)
+	}
+	return p, nil
+}
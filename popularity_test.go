@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLangPopularityDecay(t *testing.T) {
+	start := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+	p := NewLangPopularity(time.Hour, start)
+	for i := 0; i < 1000; i++ {
+		p.Add("pt")
+	}
+	for i := 0; i < 10; i++ {
+		p.Add("hu")
+	}
+	if top := p.Top(start); !reflect.DeepEqual(top, []string{"pt", "hu"}) {
+		t.Fatalf("expected pt then hu, got %#v", top)
+	}
+
+	p.Decay(start.Add(time.Hour))
+	if math.Abs(p.counts["pt"]-500) > 0.001 {
+		t.Fatalf("expected pt to halve in a half-life, got %f", p.counts["pt"])
+	}
+
+	// a new language catches up once the old one quiets down
+	for i := 0; i < 400; i++ {
+		p.Add("en")
+	}
+	if top := p.Top(start.Add(2 * time.Hour)); !reflect.DeepEqual(top, []string{"pt", "en", "hu"}) {
+		t.Fatalf("expected en second, got %#v", top)
+	}
+	if top := p.Top(start.Add(3 * time.Hour)); top[0] != "pt" {
+		t.Fatalf("expected pt still first, got %#v", top)
+	}
+	for i := 0; i < 200; i++ {
+		p.Add("en")
+	}
+	if top := p.Top(start.Add(3 * time.Hour)); top[0] != "en" {
+		t.Fatalf("expected en first, got %#v", top)
+	}
+
+	// quiet languages are forgotten altogether
+	p.Decay(start.Add(24 * time.Hour))
+	if len(p.counts) != 0 {
+		t.Fatalf("expected everything forgotten, got %#v", p.counts)
+	}
+}
+
+func TestLangPopularityBounded(t *testing.T) {
+	now := time.Now()
+	p := NewLangPopularity(time.Hour, now)
+	for i := 0; i < maxTrackedLangs; i++ {
+		p.Add(fmt.Sprintf("l%d", i))
+		p.Add(fmt.Sprintf("l%d", i))
+	}
+	p.Add("new")
+	if len(p.counts) != maxTrackedLangs || p.counts["new"] != 0 {
+		t.Fatalf("expected a new language not to displace busier ones")
+	}
+	p.Decay(now.Add(2 * time.Hour)) // everything's at 0.5
+	p.Add("new")
+	if len(p.counts) != maxTrackedLangs || p.counts["new"] != 1 {
+		t.Fatalf("expected a new language to displace a quiet one, got %d", len(p.counts))
+	}
+}
+
+func TestLangPopularitySaveLoad(t *testing.T) {
+	h := memHandler(t)
+	start := time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	p, err := LoadLangPopularity(h.DB, time.Hour, start)
+	if err != nil || len(p.counts) != 0 {
+		t.Fatalf("expected to start fresh, got %#v %#v", p, err)
+	}
+	for i := 0; i < 100; i++ {
+		p.Add("ja")
+	}
+	p.Add("en")
+	if err := p.Save(h.DB); err != nil {
+		t.Fatalf("failed to save: %#v", err)
+	}
+
+	loaded, err := LoadLangPopularity(h.DB, time.Hour, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to load: %#v", err)
+	}
+	if math.Abs(loaded.counts["ja"]-50) > 0.001 || math.Abs(loaded.counts["en"]-0.5) > 0.001 {
+		t.Fatalf("expected counts decayed for the time since saving, got %#v", loaded.counts)
+	}
+	if top := loaded.Top(start.Add(time.Hour)); !reflect.DeepEqual(top, []string{"ja", "en"}) {
+		t.Fatalf("expected the saved languages, got %#v", top)
+	}
+
+	if err := h.DB.Set(langsKey, []byte("nope"), nil); err != nil {
+		t.Fatalf("failed to set: %#v", err)
+	}
+	if _, err := LoadLangPopularity(h.DB, time.Hour, start); err == nil {
+		t.Fatalf("expected bad saved counts to fail")
+	}
+}
+
+func TestCountLangsStartsWithSaved(t *testing.T) {
+	p := NewLangPopularity(time.Hour, time.Now())
+	p.Add("fr")
+	stats := <-CountLangs(make(chan LangEvent), p, nil)
+	if !reflect.DeepEqual(stats.Known, []string{"fr"}) {
+		t.Fatalf("expected the first stats to have the known languages, got %#v", stats.Known)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// the observer websocket protocol.
+//
+// clients connect to / with the Upgrade header, optionally with their filter
+// in the query string (see FilterFromQuery), the protocol version they speak
+// as `v`, and `encoding=cbor` for binary frames instead of json text (see
+// Encoding). the server first sends a `hello`, then `post` and `observers`
+// messages as they happen.
+//
+// clients may send `setFilter` messages (and the older `setLangs` and
+// `setBulk`). each one gets either an `ack` or an `error` back, carrying the
+// message's `id` if it had one. messages sent too quickly are ignored, with a
+// `rate_limited` error.
+//
+// every message is a json object with a `type`. clients should ignore message
+// types and fields they don't know: new ones are added without bumping the
+// version, which only changes for breaking changes.
+
+const ProtocolVersion = 1
+
+// Capabilities lists the optional features this server supports
+var Capabilities = []string{
+	"filter",          // setFilter, with the filter in the query string
+	"filter.text",     // keywords and pattern in filters
+	"filter.detected", // detected languages for posts that don't declare one
+	"highlights",      // post.highlights for text filters
+	"bulk",            // post.bulk, and the filter's bulk option
+	"likes",           // post.likes
+	"dropped",         // dropped notices for slow connections
+	"compression",     // permessage-deflate, when the client offers it
+	"cbor",            // ?encoding=cbor for binary frames
+}
+
+// server → client
+
+type HelloMessage struct {
+	Type         string          `json:"type"` // "hello"
+	Version      int             `json:"version"`
+	Capabilities []string        `json:"capabilities"`
+	Redaction    RedactionPolicy `json:"redaction"`
+	KnownLangs   []string        `json:"knownLangs"`
+}
+
+// RedactionPolicy describes what's removed from posts before anyone sees them
+type RedactionPolicy struct {
+	// rich text features, and what replaces them in post text
+	Replacements map[string]string `json:"replacements"`
+	// parts of the original post that are never sent
+	Omitted []string `json:"omitted"`
+}
+
+var redactionPolicy = RedactionPolicy{
+	Replacements: map[string]string{
+		"mention": mentionReplacement,
+		"link":    linkReplacement,
+	},
+	Omitted: []string{"author", "uri", "createdAt", "embed", "facets", "tags"},
+}
+
+type PostMessageValue struct {
+	Text   string          `json:"text"`
+	Target *PostTargetType `json:"target"`
+}
+
+type PostMessagePost struct {
+	Value PostMessageValue `json:"value"`
+	// ms between the post's creation and deletion
+	Age   int64   `json:"age"`
+	Likes *uint32 `json:"likes"`
+	Bulk  bool    `json:"bulk"`
+	// only for observers with keyword or pattern filters
+	Highlights []Highlight `json:"highlights,omitempty"`
+}
+
+type PostMessage struct {
+	Type string          `json:"type"` // "post"
+	Post PostMessagePost `json:"post"`
+}
+
+type ObserversMessage struct {
+	Type      string `json:"type"` // "observers"
+	Observers int    `json:"observers"`
+}
+
+// DroppedMessage tells a client that its connection couldn't keep up, and
+// that this many messages before the next one were skipped
+type DroppedMessage struct {
+	Type  string `json:"type"` // "dropped"
+	Count int    `json:"count"`
+}
+
+type AckMessage struct {
+	Type string `json:"type"` // "ack"
+	ID   string `json:"id,omitempty"`
+	// the observer's filter after the message was applied
+	Filter ObserverFilter `json:"filter"`
+}
+
+type ProtocolErrorCode string
+
+const (
+	ErrorBadMessage          ProtocolErrorCode = "bad_message"
+	ErrorUnknownType         ProtocolErrorCode = "unknown_type"
+	ErrorInvalidFilter       ProtocolErrorCode = "invalid_filter"
+	ErrorUnsupportedVersion  ProtocolErrorCode = "unsupported_version"
+	ErrorUnsupportedEncoding ProtocolErrorCode = "unsupported_encoding"
+	ErrorRateLimited         ProtocolErrorCode = "rate_limited"
+)
+
+type ErrorMessage struct {
+	Type    string            `json:"type"` // "error"
+	ID      string            `json:"id,omitempty"`
+	Code    ProtocolErrorCode `json:"code"`
+	Message string            `json:"message"`
+}
+
+// client → server
+
+type ClientMessage struct {
+	Type string `json:"type"`
+	// optional, echoed back in the ack or error
+	ID string `json:"id,omitempty"`
+
+	// setFilter
+	Filter *ObserverFilter `json:"filter,omitempty"`
+	// setLangs (deprecated: use setFilter)
+	Langs []*string `json:"langs,omitempty"`
+	// setBulk (deprecated: use setFilter)
+	Bulk *bool `json:"bulk,omitempty"`
+}
+
+func NewHello(knownLangs []string) HelloMessage {
+	return HelloMessage{
+		Type:         "hello",
+		Version:      ProtocolVersion,
+		Capabilities: Capabilities,
+		Redaction:    redactionPolicy,
+		KnownLangs:   knownLangs,
+	}
+}
+
+func newError(id string, code ProtocolErrorCode, message string) ErrorMessage {
+	return ErrorMessage{Type: "error", ID: id, Code: code, Message: message}
+}
+
+// CheckVersion checks the `v` a client asked for when connecting
+func CheckVersion(v string) *ErrorMessage {
+	if v == "" {
+		return nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 || version > ProtocolVersion {
+		e := newError("", ErrorUnsupportedVersion,
+			fmt.Sprintf("unsupported protocol version %#v, this server speaks %d", v, ProtocolVersion))
+		return &e
+	}
+	return nil
+}
+
+// HandleClientMessage applies a client message to an observer's filter,
+// returning the new filter and the reply: an AckMessage or ErrorMessage.
+func HandleClientMessage(filter ObserverFilter, data []byte, unmarshal func([]byte, any) error) (ObserverFilter, any) {
+	var message ClientMessage
+	if err := unmarshal(data, &message); err != nil {
+		return filter, newError("", ErrorBadMessage, "messages must be objects with a type")
+	}
+
+	switch message.Type {
+	case "setFilter":
+		if message.Filter == nil {
+			return filter, newError(message.ID, ErrorBadMessage, "setFilter needs a filter")
+		}
+		if err := message.Filter.Validate(); err != nil {
+			return filter, newError(message.ID, ErrorInvalidFilter, err.Error())
+		}
+		filter = *message.Filter
+	case "setLangs":
+		next := filter
+		next.Langs = message.Langs
+		if err := next.Validate(); err != nil {
+			return filter, newError(message.ID, ErrorInvalidFilter, err.Error())
+		}
+		filter = next
+	case "setBulk":
+		if message.Bulk == nil {
+			return filter, newError(message.ID, ErrorBadMessage, "setBulk needs bulk")
+		}
+		filter.Bulk = message.Bulk
+	default:
+		return filter, newError(message.ID, ErrorUnknownType, fmt.Sprintf("unknown message type %#v", message.Type))
+	}
+	return filter, AckMessage{Type: "ack", ID: message.ID, Filter: filter}
+}
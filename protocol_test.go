@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustJson(t *testing.T, v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal %#v: %#v", v, err)
+	}
+	return string(data)
+}
+
+// the wire format third-party clients see. changing these is a protocol change.
+func TestProtocolMessages(t *testing.T) {
+	reply := ReplyTarget
+	likes := uint32(3)
+	en := "en"
+	no := false
+	for _, c := range []struct {
+		message any
+		expect  string
+	}{
+		{
+			PostMessage{Type: "post", Post: PostMessagePost{
+				Value: PostMessageValue{Text: "hi", Target: &reply},
+				Age:   1200,
+				Likes: &likes,
+				Bulk:  true,
+			}},
+			`{"type":"post","post":{"value":{"text":"hi","target":"reply"},"age":1200,"likes":3,"bulk":true}}`,
+		},
+		{
+			PostMessage{Type: "post", Post: PostMessagePost{
+				Value:      PostMessageValue{Text: "a cat"},
+				Highlights: []Highlight{{2, 5}},
+			}},
+			`{"type":"post","post":{"value":{"text":"a cat","target":null},"age":0,"likes":null,"bulk":false,"highlights":[[2,5]]}}`,
+		},
+		{
+			ObserversMessage{Type: "observers", Observers: 4},
+			`{"type":"observers","observers":4}`,
+		},
+		{
+			AckMessage{Type: "ack", ID: "1", Filter: ObserverFilter{Langs: []*string{&en, nil}, Bulk: &no}},
+			`{"type":"ack","id":"1","filter":{"langs":["en",null],"detected":false,"targets":null,"minAgeMs":0,"maxAgeMs":0,"minLikes":0,"textLongerThan":0,"bulk":false,"keywords":null,"pattern":""}}`,
+		},
+		{
+			newError("", ErrorUnknownType, "nope"),
+			`{"type":"error","code":"unknown_type","message":"nope"}`,
+		},
+	} {
+		if got := mustJson(t, c.message); got != c.expect {
+			t.Fatalf("expected\n%s\ngot\n%s", c.expect, got)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	var hello map[string]any
+	json.Unmarshal([]byte(mustJson(t, NewHello([]string{"en", "ja"}))), &hello)
+	if hello["type"] != "hello" || hello["version"] != float64(ProtocolVersion) {
+		t.Fatalf("unexpected hello: %#v", hello)
+	}
+	if !reflect.DeepEqual(hello["knownLangs"], []any{"en", "ja"}) {
+		t.Fatalf("expected known langs in hello, got %#v", hello["knownLangs"])
+	}
+	replacements := hello["redaction"].(map[string]any)["replacements"].(map[string]any)
+	if replacements["mention"] != mentionReplacement || replacements["link"] != linkReplacement {
+		t.Fatalf("expected the redaction replacements in hello, got %#v", replacements)
+	}
+}
+
+func TestHandleClientMessage(t *testing.T) {
+	en := "en"
+	start := ObserverFilter{Langs: []*string{&en}}
+
+	for _, c := range []struct {
+		message string
+		code    ProtocolErrorCode // "" for an ack
+		id      string
+		filter  string // the resulting filter's query
+	}{
+		{`nope`, ErrorBadMessage, "", "lang=en"},
+		{`{"type":"dance","id":"a"}`, ErrorUnknownType, "a", "lang=en"},
+		{`{"type":"setFilter","id":"b"}`, ErrorBadMessage, "b", "lang=en"},
+		{`{"type":"setFilter","id":"c","filter":{"minAgeMs":-1}}`, ErrorInvalidFilter, "c", "lang=en"},
+		{`{"type":"setFilter","id":"d","filter":{"pattern":"("}}`, ErrorInvalidFilter, "d", "lang=en"},
+		{`{"type":"setFilter","id":"e","filter":{"targets":["reply"],"minLikes":2}}`, "", "e", "minLikes=2&target=reply"},
+		{`{"type":"setLangs","langs":["ja",null]}`, "", "", "lang=ja&lang=null"},
+		{`{"type":"setLangs","id":"f","langs":["english!"]}`, ErrorInvalidFilter, "f", "lang=en"},
+		{`{"type":"setBulk","bulk":false}`, "", "", "bulk=false&lang=en"},
+		{`{"type":"setBulk"}`, ErrorBadMessage, "", "lang=en"},
+	} {
+		filter, reply := HandleClientMessage(start, []byte(c.message), json.Unmarshal)
+		if got := filter.Query().Encode(); got != c.filter {
+			t.Fatalf("%s: expected filter %#v, got %#v", c.message, c.filter, got)
+		}
+		switch reply := reply.(type) {
+		case AckMessage:
+			if c.code != "" {
+				t.Fatalf("%s: expected error %s, got an ack", c.message, c.code)
+			}
+			if reply.ID != c.id || reply.Filter.Query().Encode() != c.filter {
+				t.Fatalf("%s: unexpected ack %#v", c.message, reply)
+			}
+		case ErrorMessage:
+			if reply.Code != c.code || reply.ID != c.id {
+				t.Fatalf("%s: unexpected error %#v", c.message, reply)
+			}
+		default:
+			t.Fatalf("%s: unexpected reply %#v", c.message, reply)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	for _, v := range []string{"", "1"} {
+		if err := CheckVersion(v); err != nil {
+			t.Fatalf("version %#v should be supported, got %#v", v, err)
+		}
+	}
+	for _, v := range []string{"0", "2", "one"} {
+		if err := CheckVersion(v); err == nil || err.Code != ErrorUnsupportedVersion {
+			t.Fatalf("version %#v should be unsupported, got %#v", v, err)
+		}
+	}
+}
+
+func TestProtocolHandshake(t *testing.T) {
+	server := newServer(NewObserverLimits(nil, nil, 0, 0, 0), nil, NewErrorReports())
+	server.knownLangs = &[]string{"en"}
+	go server.broadcast(make(chan LikedPersistedPost), make(chan LangStats))
+	ts := httptest.NewServer(http.HandlerFunc(server.wsConnect))
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	c, _, err := websocket.DefaultDialer.Dial(wsUrl+"/?v=1&lang=en", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	defer c.Close()
+
+	var hello HelloMessage
+	if err := c.ReadJSON(&hello); err != nil || hello.Type != "hello" {
+		t.Fatalf("expected hello first, got %#v %#v", hello, err)
+	}
+
+	c.WriteJSON(map[string]any{"type": "setFilter", "id": "x", "filter": map[string]any{"minLikes": 1}})
+	for {
+		var message map[string]any
+		if err := c.ReadJSON(&message); err != nil {
+			t.Fatalf("failed to read: %#v", err)
+		}
+		if message["type"] == "observers" {
+			continue
+		}
+		if message["type"] != "ack" || message["id"] != "x" {
+			t.Fatalf("expected an ack, got %#v", message)
+		}
+		break
+	}
+
+	old, _, err := websocket.DefaultDialer.Dial(wsUrl+"/?v=99", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	defer old.Close()
+	var versionErr ErrorMessage
+	if err := old.ReadJSON(&versionErr); err != nil || versionErr.Code != ErrorUnsupportedVersion {
+		t.Fatalf("expected an unsupported version error, got %#v %#v", versionErr, err)
+	}
+}
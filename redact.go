@@ -5,6 +5,13 @@ import (
 	"sort"
 )
 
+// what mentions and links are replaced with. the protocol's hello message
+// describes these to clients (see RedactionPolicy)
+const (
+	mentionReplacement = "@█████████"
+	linkReplacement    = "www.█████████"
+)
+
 type redactable struct {
 	replacement []byte
 	index       apibsky.RichtextFacet_ByteSlice
@@ -21,12 +28,12 @@ func isRedactable(facet apibsky.RichtextFacet) *redactable {
 		if feat.RichtextFacet_Mention != nil {
 			return &redactable{
 				index:       *facet.Index,
-				replacement: []byte("@█████████"),
+				replacement: []byte(mentionReplacement),
 			}
 		} else if feat.RichtextFacet_Link != nil {
 			return &redactable{
 				index:       *facet.Index,
-				replacement: []byte("www.█████████"),
+				replacement: []byte(linkReplacement),
 			}
 		}
 	}
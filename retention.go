@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"sync"
+	"time"
+)
+
+var (
+	retentionAdjustInterval time.Duration = MustParseDuration("1m")
+	minTrimInterval         time.Duration = MustParseDuration("8s")
+	maxTrimInterval         time.Duration = MustParseDuration("1m")
+)
+
+// retention only ever moves by these factors per adjustment: range deletes
+// take a compaction or two before they show up as free disk, so reacting
+// harder than this just overshoots.
+const (
+	retentionShrinkLimit = 0.9
+	retentionGrowth      = 1.02
+	// under this fraction of the budget we can afford to keep more
+	retentionGrowBelow = 0.9
+)
+
+// the retention we'd gotten to, so a restart doesn't start back at the max
+var retentionKey = []byte("meta/retention")
+
+// RetentionController moves the cache's trim horizon to keep pebble's disk
+// usage near a budget, somewhere between a minimum and maximum retention.
+//
+// with no budget (TargetBytes == 0) retention is fixed at Max.
+//
+// while it's held (see Hold), disk usage doesn't move the retention: trims
+// only reach time-ordered keys, so until MigrateTimeKeys is done the legacy
+// posts keep the db over budget no matter how short the retention gets.
+type RetentionController struct {
+	TargetBytes uint64
+	Min         time.Duration
+	Max         time.Duration
+
+	lock      sync.Mutex
+	retention time.Duration
+	over      bool
+	held      bool
+}
+
+func NewRetentionController(targetBytes uint64, minRetention, maxRetention time.Duration) *RetentionController {
+	rc := &RetentionController{
+		TargetBytes: targetBytes,
+		Min:         minRetention,
+		Max:         maxRetention,
+		retention:   maxRetention,
+	}
+	retentionGauge.Set(maxRetention.Seconds())
+	return rc
+}
+
+func nextRetention(current time.Duration, diskBytes, targetBytes uint64, minRetention, maxRetention time.Duration) time.Duration {
+	if targetBytes == 0 {
+		return maxRetention
+	}
+	ratio := float64(diskBytes) / float64(targetBytes)
+	next := current
+	if ratio > 1 {
+		next = time.Duration(float64(current) * max(retentionShrinkLimit, 1/ratio))
+	} else if ratio < retentionGrowBelow {
+		next = time.Duration(float64(current) * retentionGrowth)
+	}
+	return min(max(next, minRetention), maxRetention)
+}
+
+// Adjust takes pebble's current disk usage and moves the retention toward the
+// budget.
+func (rc *RetentionController) Adjust(diskBytes uint64) time.Duration {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.held {
+		return rc.retention
+	}
+	rc.retention = nextRetention(rc.retention, diskBytes, rc.TargetBytes, rc.Min, rc.Max)
+	rc.over = rc.TargetBytes > 0 && diskBytes > rc.TargetBytes
+	retentionGauge.Set(rc.retention.Seconds())
+	return rc.retention
+}
+
+// Load seeds the retention from the db: where we left off if it was saved,
+// otherwise from how far over budget the db already is.
+func (rc *RetentionController) Load(db *pebble.DB) error {
+	data, closer, err := db.Get(retentionKey)
+	if err == pebble.ErrNotFound {
+		rc.seed(db.Metrics().DiskSpaceUsage())
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer closer.Close()
+	saved, err := time.ParseDuration(string(data))
+	if err != nil {
+		return fmt.Errorf("bad saved retention %#v: %w", string(data), err)
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.TargetBytes > 0 {
+		rc.retention = min(max(saved, rc.Min), rc.Max)
+	}
+	retentionGauge.Set(rc.retention.Seconds())
+	return nil
+}
+
+// seed guesses a retention with nothing saved. Adjust is too cautious to
+// start from the max with a db that's already well over budget.
+func (rc *RetentionController) seed(diskBytes uint64) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if !rc.held && rc.TargetBytes > 0 && diskBytes > rc.TargetBytes {
+		scaled := time.Duration(float64(rc.Max) * float64(rc.TargetBytes) / float64(diskBytes))
+		rc.retention = max(scaled, rc.Min)
+		rc.over = true
+	}
+	retentionGauge.Set(rc.retention.Seconds())
+}
+
+// Hold stops (or restarts) budget decisions, for while legacy posts that trims
+// can't reach are still in the db
+func (rc *RetentionController) Hold(held bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.held = held
+	if held {
+		rc.over = false // trimming faster won't help
+	}
+}
+
+// Save writes the current retention to the db for Load
+func (rc *RetentionController) Save(db *pebble.DB, opts *pebble.WriteOptions) error {
+	return db.Set(retentionKey, []byte(rc.Retention().String()), opts)
+}
+
+// Retention is how far back posts are currently kept
+func (rc *RetentionController) Retention() time.Duration {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.retention
+}
+
+// TrimInterval is how long to wait until the next trim: often while we're
+// over budget, lazily otherwise.
+func (rc *RetentionController) TrimInterval() time.Duration {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.over {
+		return minTrimInterval
+	}
+	return maxTrimInterval
+}
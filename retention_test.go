@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextRetention(t *testing.T) {
+	hour := time.Hour
+	if nextRetention(10*hour, 1_000, 0, hour, 48*hour) != 48*hour {
+		t.Fatalf("no budget should always keep the max")
+	}
+	if nextRetention(10*hour, 950, 1_000, hour, 48*hour) != 10*hour {
+		t.Fatalf("just under budget should hold steady")
+	}
+	if nextRetention(10*hour, 1_050, 1_000, hour, 48*hour) != time.Duration(float64(10*hour)/1.05) {
+		t.Fatalf("a little over budget should shrink proportionally")
+	}
+	if nextRetention(10*hour, 10_000, 1_000, hour, 48*hour) != 9*hour {
+		t.Fatalf("way over budget should shrink by at most the limit")
+	}
+	if nextRetention(10*hour, 100, 1_000, hour, 48*hour) != time.Duration(float64(10*hour)*1.02) {
+		t.Fatalf("well under budget should grow slowly")
+	}
+	if nextRetention(hour, 10_000, 1_000, hour, 48*hour) != hour {
+		t.Fatalf("retention should not shrink below the min")
+	}
+	if nextRetention(48*hour, 100, 1_000, hour, 48*hour) != 48*hour {
+		t.Fatalf("retention should not grow above the max")
+	}
+}
+
+func TestRetentionLoad(t *testing.T) {
+	h := memHandler(t)
+	hour := time.Hour
+
+	rc := NewRetentionController(1_000, hour, 48*hour)
+	rc.seed(4_000)
+	if rc.Retention() != 12*hour {
+		t.Fatalf("expected a db 4x over budget to start at a quarter of the max, got %s", rc.Retention())
+	}
+	rc.seed(100_000)
+	if rc.Retention() != hour {
+		t.Fatalf("expected the seed to stay above the min, got %s", rc.Retention())
+	}
+
+	rc = NewRetentionController(1_000, hour, 48*hour)
+	rc.Adjust(10_000)
+	if err := rc.Save(h.DB, nil); err != nil {
+		t.Fatalf("failed to save: %#v", err)
+	}
+	restarted := NewRetentionController(1_000, hour, 48*hour)
+	if err := restarted.Load(h.DB); err != nil {
+		t.Fatalf("failed to load: %#v", err)
+	}
+	if restarted.Retention() != rc.Retention() {
+		t.Fatalf("expected to pick up at %s, got %s", rc.Retention(), restarted.Retention())
+	}
+
+	narrower := NewRetentionController(1_000, 44*hour, 46*hour)
+	if err := narrower.Load(h.DB); err != nil {
+		t.Fatalf("failed to load: %#v", err)
+	}
+	if narrower.Retention() != 44*hour {
+		t.Fatalf("expected the saved retention clamped to the new min, got %s", narrower.Retention())
+	}
+}
+
+func TestRetentionHold(t *testing.T) {
+	hour := time.Hour
+	rc := NewRetentionController(1_000, hour, 48*hour)
+	rc.Hold(true)
+	rc.seed(4_000)
+	rc.Adjust(10_000)
+	if rc.Retention() != 48*hour || rc.TrimInterval() != maxTrimInterval {
+		t.Fatalf("expected a held controller to leave the retention alone, got %s", rc.Retention())
+	}
+	rc.Hold(false)
+	if rc.Adjust(10_000) != time.Duration(float64(48*hour)*retentionShrinkLimit) {
+		t.Fatalf("expected budget decisions after the hold, got %s", rc.Retention())
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// every response gets the usual security headers. pages only run their own
+// inline scripts and styles: each request gets a fresh nonce for its
+// Content-Security-Policy, and the templates put it on every <script> and
+// <style> (see IndexTemplateData.Nonce). so nonce pages can't be cached.
+
+const (
+	// two years, which is what the preload list wants
+	strictTransportSecurity = "max-age=63072000; includeSubDomains"
+	referrerPolicy          = "strict-origin-when-cross-origin"
+	permissionsPolicy       = "camera=(), geolocation=(), microphone=(), payment=(), usb=()"
+)
+
+type nonceKey struct{}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail
+	}
+	// url-safe, so templates don't escape it
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// RequestNonce is the request's CSP nonce, or "" outside withSecurityHeaders
+func RequestNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceKey{}).(string)
+	return nonce
+}
+
+// contentPolicy is the Content-Security-Policy for a page with a nonce
+func contentPolicy(nonce, frameAncestors string) string {
+	return strings.Join([]string{
+		"default-src 'none'",
+		"script-src 'nonce-" + nonce + "'",
+		"style-src 'nonce-" + nonce + "'",
+		"connect-src 'self'", // the websocket, and /oops
+		"base-uri 'none'",
+		"form-action 'none'",
+		"frame-ancestors " + frameAncestors,
+	}, "; ")
+}
+
+func withSecurityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newNonce()
+		w.Header().Set("Content-Security-Policy", contentPolicy(nonce, "'none'"))
+		w.Header().Set("Strict-Transport-Security", strictTransportSecurity)
+		w.Header().Set("Referrer-Policy", referrerPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Permissions-Policy", permissionsPolicy)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce)))
+	})
+}
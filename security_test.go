@@ -0,0 +1,102 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	policyNonce  = regexp.MustCompile(`script-src 'nonce-([^']+)'; style-src 'nonce-([^']+)'`)
+	inlineTags   = regexp.MustCompile(`<(?:script|style)\b[^>]*>`)
+	tagNonce     = regexp.MustCompile(`\bnonce="([^"]*)"`)
+	inlineAttrs  = regexp.MustCompile(`<[^>]*\s(?:on[a-z]+|style)=`)
+	javascriptJs = regexp.MustCompile(`(?i)href="javascript:`)
+)
+
+// checkNonces fails unless every inline script and style in a page carries
+// the nonce from its policy, and nothing inline sneaks past the policy
+func checkNonces(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	m := policyNonce.FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+	if m == nil || m[1] != m[2] || m[1] == "" {
+		t.Fatalf("expected a nonce policy, got %#v", w.Header().Get("Content-Security-Policy"))
+	}
+	nonce := m[1]
+	body := w.Body.String()
+	tags := inlineTags.FindAllString(body, -1)
+	if len(tags) == 0 {
+		t.Fatalf("expected some inline tags")
+	}
+	for _, tag := range tags {
+		if got := tagNonce.FindStringSubmatch(tag); got == nil || html.UnescapeString(got[1]) != nonce {
+			t.Errorf("expected %#v to have the nonce %#v", tag, nonce)
+		}
+	}
+	if attr := inlineAttrs.FindString(body); attr != "" {
+		t.Errorf("inline handlers and style attributes are blocked: %#v", attr)
+	}
+	if javascriptJs.MatchString(body) {
+		t.Errorf("javascript: urls are blocked")
+	}
+	return nonce
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	h := withSecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/anything", nil))
+	for name, value := range map[string]string{
+		"Strict-Transport-Security": strictTransportSecurity,
+		"Referrer-Policy":           referrerPolicy,
+		"X-Content-Type-Options":    "nosniff",
+		"Permissions-Policy":        permissionsPolicy,
+	} {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("expected %s %#v, got %#v", name, value, got)
+		}
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "default-src 'none'") || !strings.Contains(csp, "frame-ancestors 'none'") {
+		t.Fatalf("expected a strict policy, got %#v", csp)
+	}
+	if strings.Contains(csp, "unsafe") {
+		t.Fatalf("expected nothing unsafe, got %#v", csp)
+	}
+}
+
+func TestIndexNonces(t *testing.T) {
+	server := newServer(NewObserverLimits(nil, nil, 0, 0, 0), nil, NewErrorReports())
+	h := withSecurityHeaders(http.HandlerFunc(server.index))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	first := checkNonces(t, w)
+	if cache := w.Header().Get("Cache-Control"); !strings.Contains(cache, "no-store") {
+		t.Fatalf("pages with a nonce can't be cached, got %#v", cache)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if second := checkNonces(t, w); second == first {
+		t.Fatalf("expected a new nonce for every request")
+	}
+}
+
+func TestEmbedNonces(t *testing.T) {
+	server := newServer(NewObserverLimits(nil, nil, 0, 0, 0), FrameAncestors{"https:"}, NewErrorReports())
+	h := withSecurityHeaders(http.HandlerFunc(server.embed))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/embed?theme=light", nil))
+	checkNonces(t, w)
+	if csp := w.Header().Values("Content-Security-Policy"); len(csp) != 1 || !strings.HasSuffix(csp[0], "frame-ancestors https:") {
+		t.Fatalf("expected only the embed's policy, got %#v", csp)
+	}
+	if cache := w.Header().Get("Cache-Control"); !strings.Contains(cache, "no-store") {
+		t.Fatalf("pages with a nonce can't be cached, got %#v", cache)
+	}
+}
@@ -1,60 +1,72 @@
 package main
 
 import (
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
-//go:embed *.html
+//go:embed *.html messages.*.json
 var resources embed.FS
 
 var t = template.Must(template.ParseFS(resources, "*.html"))
 
+var (
+	// browsers answer pings on their own, so a client that misses a couple is
+	// gone, even if the tcp connection hasn't noticed yet
+	pingInterval time.Duration = MustParseDuration("20s")
+	pongWait     time.Duration = MustParseDuration("45s")
+	writeWait    time.Duration = MustParseDuration("10s")
+)
+
+// setFilter with every text filter maxed out fits with plenty of room
+const maxClientMessageBytes = 8 << 10
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  512,
 	WriteBufferSize: 1024,
+	// permessage-deflate, when the client offers it. broadcast messages are
+	// compressed once for everyone (see broadcastMessage)
+	EnableCompression: true,
 }
 
 type IndexTemplateData struct {
 	KnownLangs   []string
 	BrowserLangs []*string
+	LangStats    LangStats
+	// the page's language, and its UI text (see i18n.go)
+	Lang string
+	T    Catalog
+	// for every inline <script> and <style> (see security.go)
+	Nonce string
 }
 
 type Server struct {
-	newObserver chan chan ObserverMessage
-	langsLock   sync.Mutex
-	knownLangs  *[]string
-}
-
-type PostMessageValue struct {
-	Text   string          `json:"text"`
-	Target *PostTargetType `json:"target"`
-}
-
-type PostMessagePost struct {
-	Value PostMessageValue `json:"value"`
-	Age   int64            `json:"age"`
-	Likes *uint32          `json:"likes"`
-}
-
-type PostMessage struct {
-	Type string          `json:"type"`
-	Post PostMessagePost `json:"post"`
-}
-
-type ObserversMessage struct {
-	Type      string `json:"type"`
-	Observers int    `json:"observers"`
+	limits *ObserverLimits
+	// who may frame /embed
+	frameAncestors  FrameAncestors
+	reports         *ErrorReports
+	upgrader        websocket.Upgrader
+	newObserver     chan *observer
+	leftObserver    chan *observer
+	observerFilters chan observerFilter
+	shards          []*broadcastShard
+	langsLock       sync.Mutex
+	knownLangs      *[]string
+	langStats       LangStats
 }
 
 type ObserverMessageType string
@@ -70,25 +82,32 @@ type ObserverMessage struct {
 	Post           *LikedPersistedPost `json:"post"`
 }
 
-func (om *ObserverMessage) toJson(t time.Time) ([]byte, error) {
+// wire is the message as it's sent, in any encoding
+func (om *ObserverMessage) wire(t time.Time, highlights []Highlight) (any, error) {
 	switch om.Type {
 	case ObserverMessageTypePost:
-		return json.Marshal(PostMessage{
+		text := om.Post.Post.Text
+		if highlights != nil {
+			text = norm.NFC.String(text) // what the highlights index into
+		}
+		return PostMessage{
 			Type: "post",
 			Post: PostMessagePost{
-				Age:   om.Post.Post.AgeMs(t),
-				Likes: om.Post.Likes,
+				Highlights: highlights,
+				Age:        om.Post.Post.AgeMs(t),
+				Likes:      om.Post.Likes,
+				Bulk:       om.Post.Kind == BulkDeletion,
 				Value: PostMessageValue{
-					Text:   om.Post.Post.Text,
+					Text:   text,
 					Target: om.Post.Post.Target,
 				},
 			},
-		})
+		}, nil
 	case ObserverMessageTypeObservers:
-		return json.Marshal(ObserversMessage{
+		return ObserversMessage{
 			Type:      "observers",
 			Observers: om.ObserversCount,
-		})
+		}, nil
 	default:
 		return nil, fmt.Errorf("unhandled message type %s", om.Type)
 	}
@@ -96,132 +115,245 @@ func (om *ObserverMessage) toJson(t time.Time) ([]byte, error) {
 
 func (s *Server) index(w http.ResponseWriter, r *http.Request) {
 	log.Println("hello from", r.Header.Get("Referer"))
-	seenLangs := map[string]bool{}
-	langs := []*string{}
-	acceptHeaderValue := r.Header.Get("Accept-Language")
-	for _, lang := range strings.Split(acceptHeaderValue, ",") {
-		var l = strings.TrimSpace(lang)
-		l, _, _ = strings.Cut(l, ";")
-		l, _, _ = strings.Cut(l, "-")
-		if !seenLangs[l] {
-			langs = append(langs, &l)
-			seenLangs[l] = true
-		}
-	}
 
 	w.Header().Add("Content-Type", "text/html")
-	w.Header().Add("Cache-Control", "public, max-age=300, immutable")
+	w.Header().Add("Cache-Control", "no-store") // the nonce
 	w.Header().Add("Vary", "accept-language")
 
-	t.ExecuteTemplate(w, "index.html", IndexTemplateData{
+	t.ExecuteTemplate(w, "index.html", s.templateData(r))
+}
+
+func (s *Server) templateData(r *http.Request) IndexTemplateData {
+	pageLang, catalog := catalogs.Negotiate(r.Header.Get("Accept-Language"))
+	return IndexTemplateData{
 		KnownLangs:   s.getKnownLangs(),
-		BrowserLangs: langs,
+		BrowserLangs: browserLangs(r.Header.Get("Accept-Language")),
+		LangStats:    s.getLangStats(),
+		Lang:         pageLang,
+		T:            catalog,
+		Nonce:        RequestNonce(r),
+	}
+}
+
+// acceptLanguageTags parses Accept-Language by preference, skipping just the
+// entries that are malformed (ParseAcceptLanguage gives up on all of them)
+func acceptLanguageTags(acceptLanguage string) []language.Tag {
+	type weighted struct {
+		tag language.Tag
+		q   float32
+	}
+	entries := []weighted{}
+	for _, entry := range strings.Split(acceptLanguage, ",") {
+		tags, qs, err := language.ParseAcceptLanguage(entry)
+		if err != nil {
+			continue
+		}
+		for i, tag := range tags {
+			entries = append(entries, weighted{tag, qs[i]})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].q > entries[j].q
 	})
+	tags := []language.Tag{}
+	for _, entry := range entries {
+		tags = append(tags, entry.tag)
+	}
+	return tags
+}
+
+// browserLangs picks the filter's initial languages from Accept-Language, in
+// order of preference. they're base languages, which hear every region.
+func browserLangs(acceptLanguage string) []*string {
+	langs := []*string{}
+	seen := map[string]bool{}
+	for _, tag := range acceptLanguageTags(acceptLanguage) {
+		base, _ := tag.Base()
+		lang := base.String()
+		if tag == language.Und || lang == "mul" { // "*"
+			continue
+		}
+		if !seen[lang] {
+			langs = append(langs, &lang)
+			seen[lang] = true
+		}
+	}
+	return langs
 }
 
 func (s *Server) wsConnect(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	ip := s.limits.ClientIP(r)
+	release, reason := s.limits.Acquire(ip)
+	switch reason {
+	case "global_limit":
+		http.Error(w, "too many observers right now, try again later", http.StatusServiceUnavailable)
+		return
+	case "ip_limit":
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		release()
 		log.Println("failed to upgrade websocket connection", err)
 		return
 	}
 
-	receiver := make(chan ObserverMessage, 2)
-	pickLangs := make(chan []*string)
-	s.newObserver <- receiver
-	go listen(*c, pickLangs)
-	go notify(*c, receiver, pickLangs)
+	enc, err := GetEncoding(r.URL.Query().Get("encoding"))
+	if err != nil {
+		refuse(c, JsonEncoding, newError("", ErrorUnsupportedEncoding, err.Error()))
+		release()
+		return
+	}
 
-	if err := r.ParseForm(); err != nil {
-		log.Println("failed to get languages from websocket init. client will receive all.", err)
+	if versionErr := CheckVersion(r.URL.Query().Get("v")); versionErr != nil {
+		refuse(c, enc, *versionErr)
+		release()
 		return
 	}
 
-	var initialLangs = []*string{}
-	for _, lang := range r.Form["lang"] {
-		if lang == "null" {
-			initialLangs = append(initialLangs, nil)
-		} else {
-			initialLangs = append(initialLangs, &lang)
+	// the hello and any other replies go out through notify, the only writer
+	hello := NewHello(s.getKnownLangs())
+	replies := make(chan any, 4)
+
+	filter, err := FilterFromQuery(r.URL.Query())
+	if err != nil {
+		replies <- newError("", ErrorInvalidFilter, "ignoring the filter in the url: "+err.Error())
+		filter = ObserverFilter{}
+	}
+
+	o := newObserver(c)
+	o.enc = enc
+	if matcher, err := filter.Matcher(); err == nil {
+		o.matcher = matcher
+	}
+	o.ip = ip
+	o.release = release
+	s.newObserver <- o
+	go s.listen(o, filter, replies)
+	go s.notify(o, hello, replies)
+}
+
+// refuse ends a connection that can't go on, with an error message
+func refuse(c *websocket.Conn, enc *Encoding, e ErrorMessage) {
+	c.SetWriteDeadline(time.Now().Add(writeWait))
+	writeValue(c, enc, e)
+	c.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseUnsupportedData, e.Message))
+	c.Close()
+}
+
+// unregister removes an observer as soon as its connection ends, so that the
+// observer count stays honest. it's safe to call more than once.
+func (s *Server) unregister(o *observer) {
+	if o.close() {
+		if o.release != nil {
+			o.release()
 		}
+		s.leftObserver <- o
 	}
-	pickLangs <- initialLangs
 }
 
-func listen(c websocket.Conn, pickLangs chan<- []*string) {
-	defer c.Close()
+// listen is the connection's only reader. it owns the observer's filter, and
+// answers every client message.
+func (s *Server) listen(o *observer, filter ObserverFilter, replies chan<- any) {
+	defer s.unregister(o)
+	c := o.conn
+	c.SetReadLimit(maxClientMessageBytes)
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
-		_, message, err := c.ReadMessage()
+		messageType, message, err := c.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
-			break
+			return
 		}
-		newLangs := struct {
-			Type  string    `json:"type"`
-			Langs []*string `json:"langs"`
-		}{}
-		err = json.Unmarshal(message, &newLangs)
-		if err != nil {
-			log.Println("failed to decode client message", message)
-			continue
+		c.SetReadDeadline(time.Now().Add(pongWait))
+		var reply any
+		if s.limits.AllowMessage(o.ip, time.Now()) {
+			filter, reply = HandleClientMessage(filter, message, decoderFor(messageType))
+		} else {
+			var ignored ClientMessage
+			decoderFor(messageType)(message, &ignored)
+			reply = newError(ignored.ID, ErrorRateLimited, "slow down: message ignored")
 		}
-		if newLangs.Type != "setLangs" {
-			log.Println("unexpected client message type, ignoring", newLangs.Type)
-			continue
+		if _, ok := reply.(AckMessage); ok {
+			// acked filters are valid
+			if matcher, err := filter.Matcher(); err == nil {
+				s.observerFilters <- observerFilter{observer: o, matcher: matcher}
+			}
+		}
+		select {
+		case replies <- reply:
+		case <-o.done:
+			return
 		}
-		pickLangs <- newLangs.Langs
 	}
 }
 
-func notify(c websocket.Conn, receiver <-chan ObserverMessage, pickLangs chan []*string) {
-	defer c.Close()
-	var listenerLangs = map[string]bool{}
-	var wantsUnknownLangs = false
+// notify is the connection's only writer
+func (s *Server) notify(o *observer, hello HelloMessage, replies <-chan any) {
+	defer s.unregister(o)
+	c := o.conn
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+
+	c.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := writeValue(c, o.enc, hello); err != nil {
+		return
+	}
 	for {
 		select {
-		case message := <-receiver:
-			if message.Type == ObserverMessageTypePost &&
-				!ListeningFor(listenerLangs, wantsUnknownLangs, message.Post.Post.Langs) {
-				continue
-			}
-			data, err := message.toJson(time.Now())
-			w, err := c.NextWriter(websocket.TextMessage)
-			if err != nil {
+		case <-o.done:
+			return
+		case <-pingTicker.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
 				return
 			}
-			w.Write(data)
-			if err := w.Close(); err != nil {
-				return
+		case <-o.wake:
+			c.SetWriteDeadline(time.Now().Add(writeWait))
+			messages, dropped := o.take()
+			if dropped > 0 {
+				if err := writeValue(c, o.enc, DroppedMessage{Type: "dropped", Count: dropped}); err != nil {
+					return
+				}
 			}
-		case newLangs := <-pickLangs:
-			listenerLangs = map[string]bool{}
-			wantsUnknownLangs = false
-			for _, lang := range newLangs {
-				if lang == nil {
-					wantsUnknownLangs = true
-				} else {
-					listenerLangs[*lang] = true
+			for _, message := range messages {
+				if err := writeObserverMessage(c, o.enc, message); err != nil {
+					return
 				}
 			}
+		case reply := <-replies:
+			c.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := writeValue(c, o.enc, reply); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func (s *Server) oops(w http.ResponseWriter, r *http.Request) {
-	errInfo := map[string]interface{}{}
-	d := json.NewDecoder(r.Body)
-	d.DisallowUnknownFields()
-	err := d.Decode(&errInfo)
-	if err != nil {
-		log.Println("failed to decode json during error report, trying to continue..")
+// writeObserverMessage sends a queued message, which already passed the
+// observer's filter
+func writeObserverMessage(c *websocket.Conn, enc *Encoding, qm queuedMessage) error {
+	bm, highlights := qm.broadcastMessage, qm.highlights
+	if highlights == nil {
+		prepared := bm.prepared(enc)
+		if prepared == nil {
+			return nil // failed to serialize: already logged
+		}
+		return c.WritePreparedMessage(prepared)
 	}
-	errInfo["ua"] = r.UserAgent()
-	jsonData, err := json.Marshal(&errInfo)
-	log.Println("client error report", string(jsonData))
-	w.WriteHeader(http.StatusCreated)
-	io.WriteString(w, "got it. and sorry :/")
+	// highlights are just for this observer
+	wire, err := bm.message.wire(bm.at, highlights)
+	if err == nil {
+		err = writeValue(c, enc, wire)
+	}
+	return err
 }
 
 func (s *Server) getKnownLangs() []string {
@@ -230,64 +362,25 @@ func (s *Server) getKnownLangs() []string {
 	return *s.knownLangs
 }
 
-func (s *Server) updateLangs(newLangs *[]string) {
+func (s *Server) getLangStats() LangStats {
 	s.langsLock.Lock()
 	defer s.langsLock.Unlock()
-	s.knownLangs = newLangs
+	return s.langStats
 }
 
-func (s *Server) broadcast(deletedFeed <-chan LikedPersistedPost, knownLangsFeed <-chan []string) {
-	observers := make(map[chan ObserverMessage]bool)
-	observersCountRefresh := 7 * time.Second
-	observersCountTicker := time.NewTicker(observersCountRefresh)
-
-	sendMessage := func(message ObserverMessage) bool {
-		var toRemove = []chan ObserverMessage{}
-		for c := range observers {
-			select {
-			case c <- message:
-			default:
-				log.Println("dropping client", c)
-				toRemove = append(toRemove, c)
-			}
-		}
-		for _, c := range toRemove {
-			delete(observers, c)
-		}
-		return len(toRemove) > 0
-	}
+func (s *Server) updateLangs(stats LangStats) {
+	s.langsLock.Lock()
+	defer s.langsLock.Unlock()
+	s.knownLangs = &stats.Known
+	s.langStats = stats
+}
 
-	for {
-		select {
-		case <-observersCountTicker.C:
-			sendMessage(ObserverMessage{
-				Type:           ObserverMessageTypeObservers,
-				ObserversCount: len(observers),
-			})
-		case likedPost := <-deletedFeed:
-			if sendMessage(ObserverMessage{
-				Type: ObserverMessageTypePost,
-				Post: &likedPost,
-			}) {
-				observersCountTicker.Reset(observersCountRefresh)
-				sendMessage(ObserverMessage{
-					Type:           ObserverMessageTypeObservers,
-					ObserversCount: len(observers),
-				})
-				observersCount.Set(float64(len(observers)))
-			}
-		case newSeenLangs := <-knownLangsFeed:
-			s.updateLangs(&newSeenLangs)
-		case c := <-s.newObserver:
-			observersCountTicker.Reset(observersCountRefresh)
-			observers[c] = true
-			sendMessage(ObserverMessage{
-				Type:           ObserverMessageTypeObservers,
-				ObserversCount: len(observers),
-			})
-			observersCount.Set(float64(len(observers)))
-		}
-	}
+// langStatsApi is the latest LangStats as json
+func (s *Server) langStatsApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=4") // CountLangs' update interval
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(s.getLangStats())
 }
 
 func redirectHost(host string, h http.Handler) http.Handler {
@@ -313,16 +406,52 @@ func (s *Server) withReadyEndpoint(route string, app http.Handler) http.Handler
 	return router
 }
 
-func Serve(env, port, host string, deletedFeed <-chan LikedPersistedPost, topLangsFeed <-chan []string) {
+// adminOnly guards an admin endpoint with a bearer token. with no token set,
+// the endpoint is disabled.
+func adminOnly(adminToken string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func withAdminEndpoints(admin http.Handler, app http.Handler) http.Handler {
+	router := http.NewServeMux()
+	router.Handle("/admin/", admin)
+	router.Handle("/", app)
+	return router
+}
 
-	server := Server{
-		newObserver: make(chan chan ObserverMessage),
-		knownLangs:  &[]string{"pt", "en", "ja"},
+func newServer(limits *ObserverLimits, frameAncestors FrameAncestors, reports *ErrorReports) *Server {
+	s := &Server{
+		limits:          limits,
+		frameAncestors:  frameAncestors,
+		reports:         reports,
+		upgrader:        upgrader,
+		newObserver:     make(chan *observer),
+		leftObserver:    make(chan *observer),
+		observerFilters: make(chan observerFilter),
+		knownLangs:      &[]string{},
+		langStats:       LangStats{Langs: []LangStat{}},
 	}
+	s.upgrader.CheckOrigin = limits.CheckOrigin
+	s.shards = newBroadcastShards(s.unregister)
+	return s
+}
+
+func Serve(env, port, host string, limits *ObserverLimits, frameAncestors FrameAncestors, reports *ErrorReports, admin http.Handler, deletedFeed <-chan LikedPersistedPost, langStatsFeed <-chan LangStats) {
+
+	server := newServer(limits, frameAncestors, reports)
 
 	router := http.NewServeMux()
 	router.Handle("GET /metrics", promhttp.Handler())
 	router.HandleFunc("POST /oops", server.oops)
+	router.HandleFunc("GET /api/langs", server.langStatsApi)
+	router.HandleFunc("GET /embed", server.embed)
 	router.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" { // surprise, what a default :/
 			http.NotFound(w, r)
@@ -348,7 +477,15 @@ func Serve(env, port, host string, deletedFeed <-chan LikedPersistedPost, topLan
 	// the /ready healthcheck endpoint outside the host redirect
 	app = server.withReadyEndpoint("GET /ready", app)
 
-	go server.broadcast(deletedFeed, topLangsFeed)
+	// admin endpoints check their own auth, and are also outside the redirect
+	// so that other machines can reach them over fly's private network
+	app = withAdminEndpoints(admin, app)
+
+	app = withSecurityHeaders(app)
+
+	// CountLangs starts with the saved language list
+	server.updateLangs(<-langStatsFeed)
+	go server.broadcast(deletedFeed, langStatsFeed)
 
 	log.Println("listening on", port)
 	log.Fatal(http.ListenAndServe(":"+port, app))
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T) (*Server, string) {
+	return testServerWithLimits(t, NewObserverLimits(nil, nil, 0, 0, 0))
+}
+
+func testServerWithLimits(t *testing.T, limits *ObserverLimits) (*Server, string) {
+	server := newServer(limits, nil, NewErrorReports())
+	server.knownLangs = &[]string{"en"}
+	go server.broadcast(make(chan LikedPersistedPost), make(chan LangStats))
+	ts := httptest.NewServer(http.HandlerFunc(server.wsConnect))
+	t.Cleanup(ts.Close)
+	return server, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// readObservers reads until the next observers count
+func readObservers(t *testing.T, c *websocket.Conn) int {
+	for {
+		var message struct {
+			Type      string
+			Observers int
+		}
+		if err := c.ReadJSON(&message); err != nil {
+			t.Fatalf("failed to read: %#v", err)
+		}
+		if message.Type == "observers" {
+			return message.Observers
+		}
+	}
+}
+
+func TestObserverLifecycle(t *testing.T) {
+	_, wsUrl := testServer(t)
+	// let the server's own goroutines settle before counting
+	time.Sleep(10 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	clients := []*websocket.Conn{}
+	for i := 0; i < 50; i++ {
+		c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+		if err != nil {
+			t.Fatalf("failed to connect: %#v", err)
+		}
+		clients = append(clients, c)
+	}
+	if n := readObservers(t, clients[len(clients)-1]); n != 50 {
+		t.Fatalf("expected 50 observers, got %d", n)
+	}
+	for i, c := range clients {
+		if i%2 == 0 {
+			// politely
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}
+		c.Close()
+	}
+
+	// the count drops as soon as they're gone, without waiting for a post
+	probe, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for n := readObservers(t, probe); n != 1; n = readObservers(t, probe) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the probe to be observing, got %d", n)
+		}
+	}
+	probe.Close()
+
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("leaked %d goroutines:\n%s",
+				runtime.NumGoroutine()-baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestObserverReadDeadline(t *testing.T) {
+	defer func(wait time.Duration) { pongWait = wait }(pongWait)
+	pongWait = 50 * time.Millisecond
+	_, wsUrl := testServer(t)
+
+	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %#v", err)
+	}
+	defer c.Close()
+	// no ping goes out before pongWait, so no pong comes back: the server
+	// should give up on the client
+	start := time.Now()
+	c.SetReadDeadline(start.Add(5 * time.Second))
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("expected the server to close the connection after its read deadline")
+	}
+}
+
+func TestLangStatsRendering(t *testing.T) {
+	server := newServer(NewObserverLimits(nil, nil, 0, 0, 0), nil, NewErrorReports())
+	en := "en"
+	server.updateLangs(LangStats{
+		WindowSeconds: 3600,
+		Posts:         1000,
+		Deletions:     100,
+		Ratio:         0.1,
+		Langs: []LangStat{
+			{Lang: &en, Posts: 900, Deletions: 50, Ratio: 50.0 / 900},
+			{Lang: nil, Posts: 300, Deletions: 150, Ratio: 0.5, Unusual: true},
+		},
+		Known: []string{"en"},
+	})
+
+	w := httptest.NewRecorder()
+	server.index(w, httptest.NewRequest("GET", "/", nil))
+	page := w.Body.String()
+	if !strings.Contains(page, `<tr class="unusual"`) || !strings.Contains(page, "<td>unknown</td>") ||
+		!strings.Contains(page, "<td>50.0%</td>") || !strings.Contains(page, "last 60 minutes") {
+		t.Errorf("expected the language stats table in the page")
+	}
+
+	w = httptest.NewRecorder()
+	server.langStatsApi(w, httptest.NewRequest("GET", "/api/langs", nil))
+	var stats map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode: %#v", err)
+	}
+	langs := stats["langs"].([]any)
+	if len(langs) != 2 || langs[1].(map[string]any)["lang"] != nil || stats["known"] != nil {
+		t.Errorf("unexpected stats %#v", stats)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a snapshot is a gzipped tar of a pebble checkpoint of the cache, plus a
+// small manifest. the jetstream cursor lives inside the db (cursorKey), so a
+// restored cache picks up the firehose where the snapshot left it.
+//
+// to seed a new machine from an old one, set RESTORE_FROM on the new one to
+// the old one's snapshot endpoint (or to an archive on disk), with the same
+// ADMIN_TOKEN on both:
+//
+//	RESTORE_FROM=http://old-machine.vm.bsky-deletions.internal:8080/admin/snapshot
+//
+// the restore only happens when there's no cache at DB_PATH yet.
+
+var cursorKey = []byte("meta/cursor")
+
+var (
+	// jetstream's parallel scheduler can finish events a little out of order,
+	// so resume from a bit before the newest one we saw. replaying a few
+	// seconds is harmless: creates overwrite and deletes miss.
+	cursorRewind time.Duration = MustParseDuration("5s")
+	// older cursors than this are stale: start live instead of replaying
+	// (jetstream only keeps so much anyway)
+	maxCursorAge time.Duration = MustParseDuration("1h")
+)
+
+const snapshotManifestName = "snapshot.json"
+
+type SnapshotManifest struct {
+	CursorUS  int64     `json:"cursor_us"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// observeCursor keeps the newest event time we've handled
+func (h *PostHandler) observeCursor(timeUS int64) {
+	for {
+		current := h.cursor.Load()
+		if timeUS <= current || h.cursor.CompareAndSwap(current, timeUS) {
+			return
+		}
+	}
+}
+
+// ResumeCursor is where to reconnect to jetstream from, or nil to start live.
+// events up to the newest one handled so far are replays from then on.
+func (h *PostHandler) ResumeCursor() *int64 {
+	cursor := h.cursor.Load()
+	if cursor == 0 || time.Since(time.UnixMicro(cursor)) > maxCursorAge {
+		h.replayedUntil.Store(0)
+		return nil
+	}
+	h.replayedUntil.Store(cursor)
+	cursor -= cursorRewind.Microseconds()
+	return &cursor
+}
+
+// Replayed checks whether an event was already handled before reconnecting.
+// events that are just late (jetstream or us lagging) aren't replays.
+func (h *PostHandler) Replayed(timeUS int64) bool {
+	return timeUS <= h.replayedUntil.Load()
+}
+
+// SaveCursor writes the current cursor to the db
+func (h *PostHandler) SaveCursor(opts *pebble.WriteOptions) error {
+	cursor := h.cursor.Load()
+	if cursor == 0 {
+		return nil
+	}
+	return h.DB.Set(cursorKey, []byte(strconv.FormatInt(cursor, 10)), opts)
+}
+
+// LoadCursor reads the saved cursor from the db, if there is one
+func (h *PostHandler) LoadCursor() error {
+	data, closer, err := h.DB.Get(cursorKey)
+	if err == pebble.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer closer.Close()
+	cursor, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad saved cursor %#v: %w", string(data), err)
+	}
+	h.observeCursor(cursor)
+	return nil
+}
+
+// Snapshot writes an archive of the live cache to w
+func (h *PostHandler) Snapshot(w io.Writer) error {
+	if err := h.SaveCursor(pebble.Sync); err != nil {
+		return fmt.Errorf("failed to save cursor: %w", err)
+	}
+	manifest := SnapshotManifest{
+		CursorUS:  h.cursor.Load(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	tmp, err := os.MkdirTemp("", "posts-cache-snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	checkpoint := filepath.Join(tmp, "db") // must not exist yet
+	if err := h.DB.Checkpoint(checkpoint, pebble.WithFlushedWAL()); err != nil {
+		return fmt.Errorf("failed to checkpoint: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, snapshotManifestName, int64(len(manifestJson)), strings.NewReader(string(manifestJson))); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(checkpoint)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := addTarFile(tw, checkpoint, entry.Name()); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addTarFile(tw *tar.Writer, dir, name string) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeTarFile(tw, "db/"+name, info.Size(), f)
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// RestoreSnapshot unpacks an archive from Snapshot into a new cache at dbPath
+func RestoreSnapshot(r io.Reader, dbPath string) (*SnapshotManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a snapshot archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	// unpack beside the destination and move it into place once complete, so
+	// a failed restore never leaves a half-written cache behind
+	tmp, err := os.MkdirTemp(filepath.Dir(dbPath), ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var manifest *SnapshotManifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry in snapshot: %#v", header.Name)
+		}
+		if header.Name == snapshotManifestName {
+			manifest = &SnapshotManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("bad snapshot manifest: %w", err)
+			}
+			continue
+		}
+		dir, name := filepath.Split(header.Name)
+		if dir != "db/" || name == "" || name == "." || name == ".." {
+			return nil, fmt.Errorf("unexpected entry in snapshot: %#v", header.Name)
+		}
+		f, err := os.OpenFile(filepath.Join(tmp, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack %#v: %w", header.Name, err)
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("snapshot has no manifest")
+	}
+
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// RestoreOnBoot seeds an empty cache at dbPath from a snapshot archive, given
+// as a local path or an http(s) url
+func RestoreOnBoot(from, dbPath, adminToken string) error {
+	if entries, err := os.ReadDir(dbPath); err == nil && len(entries) > 0 {
+		log.Printf("cache already exists at %s, not restoring from snapshot", dbPath)
+		return nil
+	} else if err == nil {
+		if err := os.Remove(dbPath); err != nil { // empty: make room for the rename
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var archive io.ReadCloser
+	if strings.HasPrefix(from, "http://") || strings.HasPrefix(from, "https://") {
+		req, err := http.NewRequest("GET", from, nil)
+		if err != nil {
+			return err
+		}
+		if adminToken != "" {
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("snapshot request failed: %s", res.Status)
+		}
+		archive = res.Body
+	} else {
+		f, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		archive = f
+	}
+	defer archive.Close()
+
+	log.Printf("restoring cache from snapshot %s...", from)
+	manifest, err := RestoreSnapshot(archive, dbPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("restored cache snapshot from %s, cursor %s",
+		manifest.CreatedAt.Format(time.RFC3339),
+		time.UnixMicro(manifest.CursorUS).UTC().Format(time.RFC3339))
+	return nil
+}
+
+// SnapshotHandler streams a snapshot of the live cache, for a bearer token
+func SnapshotHandler(h *PostHandler, adminToken string) http.HandlerFunc {
+	return adminOnly(adminToken, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="posts-cache.tar.gz"`)
+		if err := h.Snapshot(w); err != nil {
+			// probably mid-stream already: the truncated archive fails to
+			// unpack on the other end
+			log.Printf("snapshot failed: %s", err)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	db, err := OpenCache(t.TempDir(), storageProfiles["stock"])
+	if err != nil {
+		t.Fatalf("failed to open cache: %#v", err)
+	}
+	defer db.Close()
+	h := &PostHandler{DB: db}
+	now := time.Now().UnixMicro()
+	h.PersistEvent("did:plc:a", "3lbb2ddbbn22c", PersistedPost{TimeUS: now, Text: "hello"})
+	h.observeCursor(now)
+
+	var archive bytes.Buffer
+	if err := h.Snapshot(&archive); err != nil {
+		t.Fatalf("snapshot failed: %#v", err)
+	}
+
+	restorePath := filepath.Join(t.TempDir(), "restored")
+	manifest, err := RestoreSnapshot(bytes.NewReader(archive.Bytes()), restorePath)
+	if err != nil {
+		t.Fatalf("restore failed: %#v", err)
+	}
+	if manifest.CursorUS != now {
+		t.Fatalf("expected manifest cursor %d, got %d", now, manifest.CursorUS)
+	}
+
+	restoredDb, err := OpenCache(restorePath, storageProfiles["stock"])
+	if err != nil {
+		t.Fatalf("failed to open restored cache: %#v", err)
+	}
+	defer restoredDb.Close()
+	restored := &PostHandler{DB: restoredDb}
+	if post, err := restored.GetEvent("did:plc:a", "3lbb2ddbbn22c"); err != nil || post.Text != "hello" {
+		t.Fatalf("expected the post in the restored cache, got %#v %#v", post, err)
+	}
+	if err := restored.LoadCursor(); err != nil {
+		t.Fatalf("failed to load cursor: %#v", err)
+	}
+	if cursor := restored.ResumeCursor(); cursor == nil || *cursor != now-cursorRewind.Microseconds() {
+		t.Fatalf("expected to resume a little before the snapshot's cursor, got %#v", cursor)
+	}
+
+	if _, err := RestoreSnapshot(bytes.NewReader([]byte("nope")), filepath.Join(t.TempDir(), "bad")); err == nil {
+		t.Fatalf("restoring garbage should fail")
+	}
+}
+
+func TestResumeCursor(t *testing.T) {
+	h := &PostHandler{}
+	if h.ResumeCursor() != nil {
+		t.Fatalf("no cursor should start live")
+	}
+	h.observeCursor(time.Now().Add(-2 * maxCursorAge).UnixMicro())
+	if h.ResumeCursor() != nil {
+		t.Fatalf("a stale cursor should start live")
+	}
+	recent := time.Now().UnixMicro()
+	h.observeCursor(recent)
+	h.observeCursor(recent - 1000) // out of order events don't move it back
+	if cursor := h.ResumeCursor(); cursor == nil || *cursor != recent-cursorRewind.Microseconds() {
+		t.Fatalf("expected to resume from the newest event, got %#v", cursor)
+	}
+	if !h.Replayed(recent-1000) || !h.Replayed(recent) {
+		t.Fatalf("events up to the cursor should be replays")
+	}
+	// late, but new to us
+	if h.Replayed(recent + 1) {
+		t.Fatalf("events after the cursor shouldn't be replays, however old")
+	}
+}
+
+func TestSnapshotHandlerAuth(t *testing.T) {
+	h := memHandler(t)
+	for _, c := range []struct {
+		token  string
+		header string
+		status int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/admin/snapshot", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		SnapshotHandler(h, c.token).ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Fatalf("token %#v header %#v: expected %d, got %d", c.token, c.header, c.status, w.Code)
+		}
+	}
+}
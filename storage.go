@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"sort"
+	"time"
+)
+
+// StorageProfile is a set of pebble tuning knobs for the post cache, picked
+// with CACHE_PROFILE.
+//
+// the cache's workload is simple: a steady stream of small point writes,
+// point lookups for deletes that mostly miss, and a range delete of the
+// oldest posts every few seconds. the knobs that matter are memory (block
+// cache and memtables), how much L0 is allowed to pile up, bloom filters so
+// that lookup misses don't touch every level, and getting range deletes
+// flushed so delete-only compactions can reclaim their space promptly.
+//
+// to compare profiles under load (synthetic, or a jetstream capture):
+//
+//	go test -run '^$' -bench BenchmarkStorageProfiles -benchtime 200000x
+//	FIREHOSE_REPLAY=capture.ndjson go test -run '^$' -bench BenchmarkStorageProfiles
+//
+// which reports events/s and the peak RSS while replaying, over what the
+// process held when it started (so a loaded capture doesn't count). the go
+// heap carries over between profiles in one process, so to compare memory run
+// one at a time, eg. -bench 'BenchmarkStorageProfiles/small$'.
+//
+// the numbers on each profile are from a 1 vCPU Xeon VM with 6GB (go 1.27),
+// replaying 2M synthetic events (-benchtime 2000000x), one profile per
+// process, three to six runs each. a few MB either way is noise.
+type StorageProfile struct {
+	// block cache shared by all tables. 0 = pebble's default (8MB)
+	BlockCacheBytes int64
+	// size of each memtable, and how many can queue for flushing before
+	// writes stop. 0 = pebble's defaults (4MB, 2)
+	MemTableBytes               uint64
+	MemTableStopWritesThreshold int
+	// L0 sublevels before compacting, and before stopping writes.
+	// 0 = pebble's defaults (4, 12)
+	L0CompactionThreshold int
+	L0StopWritesThreshold int
+	// bloom filter bits per key on every level. 0 = no filters
+	BloomBitsPerKey int
+	// force a flush of memtables holding range deletes after this long, so the
+	// trimmed space is reclaimed. 0 = only flush when full
+	FlushDelayDeleteRange time.Duration
+	// pace deletion of obsolete sstables (bytes/s) so a big trim doesn't
+	// stall the disk. 0 = unpaced
+	TargetByteDeletionRate int
+}
+
+var storageProfiles = map[string]StorageProfile{
+	// pebble's defaults: what the cache ran with before profiles existed.
+	// 39-48k events/s, 50-62MB peak RSS
+	"stock": {},
+
+	// the fly 1GB VM: memory capped at or under pebble's defaults (half the
+	// block cache), leaving room for observers. the rest is for keeping disk
+	// in check. 41-49k events/s, 49-62MB peak RSS
+	"small": {
+		BlockCacheBytes:             4 << 20,
+		MemTableBytes:               4 << 20,
+		MemTableStopWritesThreshold: 2,
+		L0CompactionThreshold:       4,
+		L0StopWritesThreshold:       12,
+		BloomBitsPerKey:             10,
+		FlushDelayDeleteRange:       MustParseDuration("30s"),
+		TargetByteDeletionRate:      32 << 20,
+	},
+
+	// a machine with memory to spare: fewer, bigger flushes and more of the
+	// cache in memory. 65-74k events/s, 163-179MB peak RSS
+	"large": {
+		BlockCacheBytes:             512 << 20,
+		MemTableBytes:               64 << 20,
+		MemTableStopWritesThreshold: 4,
+		L0CompactionThreshold:       4,
+		L0StopWritesThreshold:       24,
+		BloomBitsPerKey:             10,
+		FlushDelayDeleteRange:       MustParseDuration("30s"),
+		TargetByteDeletionRate:      128 << 20,
+	},
+}
+
+const defaultStorageProfile = "small"
+
+func GetStorageProfile(name string) (StorageProfile, error) {
+	if name == "" {
+		name = defaultStorageProfile
+	}
+	profile, ok := storageProfiles[name]
+	if !ok {
+		names := []string{}
+		for n := range storageProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return StorageProfile{}, fmt.Errorf("unknown storage profile %#v, expected one of %v", name, names)
+	}
+	return profile, nil
+}
+
+// Options builds pebble options for the profile. the returned cache (nil if
+// the profile uses pebble's default) must be Unref'd once the db is open.
+func (p StorageProfile) Options() (*pebble.Options, *pebble.Cache) {
+	opts := &pebble.Options{
+		MemTableSize:                p.MemTableBytes,
+		MemTableStopWritesThreshold: p.MemTableStopWritesThreshold,
+		L0CompactionThreshold:       p.L0CompactionThreshold,
+		L0StopWritesThreshold:       p.L0StopWritesThreshold,
+		FlushDelayDeleteRange:       p.FlushDelayDeleteRange,
+		TargetByteDeletionRate:      p.TargetByteDeletionRate,
+	}
+
+	var cache *pebble.Cache
+	if p.BlockCacheBytes > 0 {
+		cache = pebble.NewCache(p.BlockCacheBytes)
+		opts.Cache = cache
+	}
+
+	if p.BloomBitsPerKey > 0 {
+		opts.Levels = make([]pebble.LevelOptions, 7)
+		for i := range opts.Levels {
+			opts.Levels[i].FilterPolicy = bloom.FilterPolicy(p.BloomBitsPerKey)
+			opts.Levels[i].FilterType = pebble.TableFilter
+		}
+	}
+
+	opts.EnsureDefaults()
+	return opts, cache
+}
+
+// OpenCache opens the post cache's pebble db with a storage profile
+func OpenCache(dbPath string, profile StorageProfile) (*pebble.DB, error) {
+	return openCache(dbPath, profile, func(*pebble.Options) {})
+}
+
+// OpenExistingCache opens a post cache without creating one if it's missing,
+// for the offline tools
+func OpenExistingCache(dbPath string, profile StorageProfile, readOnly bool) (*pebble.DB, error) {
+	return openCache(dbPath, profile, func(opts *pebble.Options) {
+		opts.ErrorIfNotExists = true
+		opts.ReadOnly = readOnly
+	})
+}
+
+func openCache(dbPath string, profile StorageProfile, configure func(*pebble.Options)) (*pebble.DB, error) {
+	opts, cache := profile.Options()
+	opts.EventListener = pebbleEventListener()
+	configure(opts)
+	db, err := pebble.Open(dbPath, opts)
+	if cache != nil {
+		cache.Unref() // the db holds its own ref now
+	}
+	return db, err
+}
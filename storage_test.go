@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayEvent is the part of a firehose event the cache sees
+type replayEvent struct {
+	Did    string
+	RKey   string
+	TimeUS int64
+	Delete bool
+	Text   string
+}
+
+// syntheticFirehose is shaped roughly like the real thing: mostly creates of
+// short posts, with a few percent deleted. most deletes are for posts the
+// cache never saw, and the rest reach back far enough to read sstables.
+//
+// events are made as they're asked for, so the replay doesn't sit in the heap
+// and inflate the garbage the benchmark's RSS sees.
+func syntheticFirehose(n int) func(i int) replayEvent {
+	// ~5k events/s, ending now
+	start := time.Now().UnixMicro() - int64(n)*200
+	text := strings.Repeat("words words words ", 6)
+	return func(i int) replayEvent {
+		// every 26th event deletes something
+		post := i/26*25 + i%26
+		timeUS := start + int64(i)*200
+		if i%26 != 25 {
+			did := fmt.Sprintf("did:plc:%024d", post%50_000)
+			return replayEvent{Did: did, RKey: fmt.Sprintf("3l%011d", post), TimeUS: timeUS, Text: text}
+		}
+		j := max(post-(post*7919)%100_000, 0) // an earlier post, sometimes already gone
+		rkey := fmt.Sprintf("3l%011d", j)
+		if i%4 != 0 {
+			rkey = fmt.Sprintf("3k%011d", j) // from before the cache
+		}
+		return replayEvent{
+			Did:    fmt.Sprintf("did:plc:%024d", j%50_000),
+			RKey:   rkey,
+			TimeUS: timeUS,
+			Delete: true,
+		}
+	}
+}
+
+// loadFirehose reads a jetstream capture (one event json per line)
+func loadFirehose(b *testing.B, path string) []replayEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatalf("failed to open firehose replay: %#v", err)
+	}
+	defer f.Close()
+
+	events := []replayEvent{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 1<<20)
+	for scanner.Scan() {
+		var event models.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if event.Commit == nil || event.Commit.Collection != "app.bsky.feed.post" {
+			continue
+		}
+		replay := replayEvent{
+			Did:    event.Did,
+			RKey:   event.Commit.RKey,
+			TimeUS: event.TimeUS,
+			Delete: event.Commit.Operation == models.CommitOperationDelete,
+		}
+		if !replay.Delete {
+			var record struct{ Text string }
+			json.Unmarshal(event.Commit.Record, &record)
+			replay.Text = record.Text
+		}
+		events = append(events, replay)
+	}
+	return events
+}
+
+// rssBytes is the process's current resident memory (linux only)
+// procStatusBytes reads a size like VmRSS or VmHWM (peak RSS) from
+// /proc/self/status
+func procStatusBytes(field string) (int64, bool) {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			return kb * 1024, err == nil
+		}
+	}
+	return 0, false
+}
+
+// resetPeakRSS starts VmHWM over from the current RSS
+func resetPeakRSS() bool {
+	return os.WriteFile("/proc/self/clear_refs", []byte("5"), 0) == nil
+}
+
+func BenchmarkStorageProfiles(b *testing.B) {
+	names := []string{}
+	for name := range storageProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b.Run(name, func(b *testing.B) {
+			replay := syntheticFirehose(b.N)
+			if path := os.Getenv("FIREHOSE_REPLAY"); path != "" {
+				events := loadFirehose(b, path)
+				if len(events) == 0 {
+					b.Fatalf("no events to replay")
+				}
+				replay = func(i int) replayEvent { return events[i%len(events)] }
+			}
+
+			db, err := OpenCache(b.TempDir(), storageProfiles[name])
+			if err != nil {
+				b.Fatalf("failed to open cache: %#v", err)
+			}
+			defer db.Close()
+			h := &PostHandler{
+				DB: db,
+				// keep a few minutes of the replay so trims have work to do
+				Retention: NewRetentionController(0, time.Minute, 3*time.Minute),
+			}
+
+			// measure from here, so a loaded capture isn't counted
+			runtime.GC()
+			debug.FreeOSMemory()
+			baseRSS, rssOk := procStatusBytes("VmRSS")
+			rssOk = rssOk && resetPeakRSS()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				event := replay(i)
+				if event.Delete {
+					h.TakeEvent(event.Did, event.RKey)
+				} else {
+					h.PersistEvent(event.Did, event.RKey, PersistedPost{TimeUS: event.TimeUS, Text: event.Text})
+				}
+				if i%40_000 == 0 { // about every 8s of real traffic
+					h.TrimEvents(nil)
+				}
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+			if peak, ok := procStatusBytes("VmHWM"); ok && rssOk {
+				b.ReportMetric(float64(peak-baseRSS)/(1<<20), "peak-rss-MB")
+			}
+		})
+	}
+}
+
+func TestStorageProfiles(t *testing.T) {
+	for name := range storageProfiles {
+		db, err := OpenCache(t.TempDir(), storageProfiles[name])
+		if err != nil {
+			t.Fatalf("profile %s failed to open: %#v", name, err)
+		}
+		db.Close()
+	}
+	if _, err := GetStorageProfile("nope"); err == nil {
+		t.Fatalf("unknown profiles should be an error")
+	}
+}